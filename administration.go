@@ -23,40 +23,51 @@ package esbulk
 
 import (
 	"fmt"
-	"log"
+	"io"
 
 	"github.com/segmentio/encoding/json"
 )
 
-// FlushIndex flushes index.
+// FlushIndex flushes index, using the server at a given position.
 func FlushIndex(idx int, options Options) error {
-	server := options.Servers[idx]
+	return flushIndex(options.Servers[idx], options)
+}
+
+// flushIndex flushes the index, using a given server.
+func flushIndex(server string, options Options) error {
 	link := fmt.Sprintf("%s/%s/_flush", server, options.Index)
 	req, err := CreateHTTPRequest("POST", link, nil, options)
 	if err != nil {
 		return err
 	}
-	resp, err := options.client().Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if options.Verbose {
-		log.Printf("index flushed: %s\n", resp.Status)
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("flush failed with %s: %s", resp.Status, string(b))
 	}
+	options.logger().Debug("index flushed", "index", options.Index, "server", server, "status", resp.Status)
 	return nil
 }
 
-// GetSettings fetches the settings of the index.
+// GetSettings fetches the settings of the index, using the server at a given
+// position.
 func GetSettings(idx int, options Options) (map[string]any, error) {
-	server := options.Servers[idx]
+	return getSettings(options.Servers[idx], options)
+}
+
+// getSettings fetches the settings of the index, using a given server.
+func getSettings(server string, options Options) (map[string]any, error) {
 	link := fmt.Sprintf("%s/%s/_settings", server, options.Index)
 
 	req, err := CreateHTTPRequest("GET", link, nil, options)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := options.client().Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return nil, err
 	}
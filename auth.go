@@ -0,0 +1,186 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidHeader is returned for a header not in "Name: value" form.
+var ErrInvalidHeader = errors.New("header syntax is: Name: value")
+
+// Authenticator adds credentials or other headers to a request before it is
+// sent. Implementations must be safe for concurrent use.
+type Authenticator interface {
+	Authenticate(req *http.Request) error
+}
+
+// BasicAuth authenticates with username and password.
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Authenticate sets the basic auth header.
+func (a BasicAuth) Authenticate(req *http.Request) error {
+	req.SetBasicAuth(a.Username, a.Password)
+	return nil
+}
+
+// APIKeyAuth authenticates with an encoded elasticsearch API key.
+type APIKeyAuth struct {
+	Key string
+}
+
+// Authenticate sets the api key header.
+func (a APIKeyAuth) Authenticate(req *http.Request) error {
+	req.Header.Set("Authorization", "ApiKey "+a.Key)
+	return nil
+}
+
+// TokenSource returns a fresh bearer token along with its expiry time. A zero
+// expiry means the token does not expire.
+type TokenSource func(ctx context.Context) (token string, expiry time.Time, err error)
+
+// BearerAuth authenticates with a bearer token. If a refresh function is
+// given, it is used to obtain the first token and to replace expired ones.
+type BearerAuth struct {
+	mu      sync.Mutex
+	token   string
+	expiry  time.Time
+	refresh TokenSource
+}
+
+// bearerExpiryMargin is the time before expiry, at which a token is refreshed.
+const bearerExpiryMargin = 30 * time.Second
+
+// NewBearerAuth creates a bearer authenticator with a static token and an
+// optional refresh function.
+func NewBearerAuth(token string, refresh TokenSource) *BearerAuth {
+	return &BearerAuth{token: token, refresh: refresh}
+}
+
+// NewBearerTokenFile creates a bearer authenticator, that reads the token from
+// a file and rereads it after a given interval, e.g. for rotated secrets.
+func NewBearerTokenFile(filename string, interval time.Duration) *BearerAuth {
+	return NewBearerAuth("", func(ctx context.Context) (string, time.Time, error) {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return strings.TrimSpace(string(b)), time.Now().Add(interval), nil
+	})
+}
+
+// Authenticate sets the bearer token header, refreshing the token first, if
+// it is missing or about to expire.
+func (a *BearerAuth) Authenticate(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stale := a.token == "" || (!a.expiry.IsZero() && time.Now().Add(bearerExpiryMargin).After(a.expiry))
+	if stale && a.refresh != nil {
+		token, expiry, err := a.refresh(req.Context())
+		if err != nil {
+			return fmt.Errorf("failed to refresh bearer token: %w", err)
+		}
+		a.token, a.expiry = token, expiry
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// HeaderAuth adds arbitrary headers, e.g. required by a gateway in front of
+// elasticsearch.
+type HeaderAuth http.Header
+
+// ParseHeaders parses headers given as "Name: value", like curl -H.
+func ParseHeaders(values []string) (HeaderAuth, error) {
+	h := make(http.Header)
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, ":")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, v)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return HeaderAuth(h), nil
+}
+
+// Authenticate adds the headers to the request.
+func (a HeaderAuth) Authenticate(req *http.Request) error {
+	for name, values := range a {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return nil
+}
+
+// MultiAuth applies several authenticators in order.
+type MultiAuth []Authenticator
+
+// Authenticate applies all authenticators, stopping at the first error.
+func (a MultiAuth) Authenticate(req *http.Request) error {
+	for _, auth := range a {
+		if err := auth.Authenticate(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticator builds the authenticator for a run from the configured
+// credentials, extra headers and a custom authenticator, if any.
+func (r *Runner) authenticator() (Authenticator, error) {
+	var auth MultiAuth
+	switch {
+	case r.Username != "":
+		auth = append(auth, BasicAuth{Username: r.Username, Password: r.Password})
+	case r.ApiKey != "":
+		auth = append(auth, APIKeyAuth{Key: r.ApiKey})
+	case strings.HasPrefix(r.BearerToken, "@"):
+		auth = append(auth, NewBearerTokenFile(r.BearerToken[1:], time.Minute))
+	case r.BearerToken != "":
+		auth = append(auth, NewBearerAuth(r.BearerToken, nil))
+	}
+	if r.Auth != nil {
+		auth = append(auth, r.Auth)
+	}
+	if len(r.Headers) > 0 {
+		headers, err := ParseHeaders(r.Headers)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, headers)
+	}
+	if len(auth) == 0 {
+		return nil, nil
+	}
+	return auth, nil
+}
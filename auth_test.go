@@ -0,0 +1,68 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBearerAuthRefresh(t *testing.T) {
+	var calls int
+	auth := NewBearerAuth("", func(ctx context.Context) (string, time.Time, error) {
+		calls++
+		if calls == 1 {
+			return "first", time.Now().Add(time.Second), nil
+		}
+		return "second", time.Now().Add(time.Hour), nil
+	})
+	for _, want := range []string{"Bearer first", "Bearer second", "Bearer second"} {
+		req, _ := http.NewRequest("GET", "http://localhost:9200", nil)
+		if err := auth.Authenticate(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("got %d refresh calls, want 2", calls)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	h, err := ParseHeaders([]string{"X-Tenant: foo", "X-Trace:a:b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := http.Header(h).Get("X-Tenant"); got != "foo" {
+		t.Fatalf("got %q", got)
+	}
+	if got := http.Header(h).Get("X-Trace"); got != "a:b" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := ParseHeaders([]string{"nocolon"}); err == nil {
+		t.Fatal("expected error")
+	}
+}
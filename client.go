@@ -0,0 +1,284 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sethgrid/pester"
+)
+
+var (
+	// ErrInvalidTLSVersion is returned for an unknown minimum TLS version.
+	ErrInvalidTLSVersion = errors.New("tls version must be one of 1.0, 1.1, 1.2, 1.3")
+	// ErrInvalidCloudID is returned for a malformed Elastic Cloud ID.
+	ErrInvalidCloudID = errors.New("invalid cloud id")
+	// ErrInvalidProxy is returned for a proxy URL with an unsupported scheme.
+	ErrInvalidProxy = errors.New("proxy must be an http, https or socks5 URL")
+)
+
+// ClientConfig configures the HTTP client used for all requests.
+type ClientConfig struct {
+	// Timeout for HTTP requests (default: 30s)
+	Timeout            time.Duration
+	InsecureSkipVerify bool
+	// CACert is a PEM file with root certificates to trust in addition to
+	// the system pool, e.g. of an internal CA.
+	CACert string
+	// ClientCert and ClientKey are PEM files for mutual TLS. If ClientKey is
+	// empty, the key is expected in ClientCert.
+	ClientCert string
+	ClientKey  string
+	// ServerName overrides the name used to verify the server certificate.
+	ServerName string
+	// MinTLSVersion is the minimum TLS version, e.g. "1.2".
+	MinTLSVersion string
+	// AWSRegion enables AWS signature version 4 signing for the given
+	// region, AWSService defaults to "es".
+	AWSRegion  string
+	AWSService string
+	// Proxy is an http, https or socks5 proxy URL for all requests, except
+	// for hosts listed in NO_PROXY. If empty, HTTP_PROXY, HTTPS_PROXY and
+	// NO_PROXY from the environment are used.
+	Proxy string
+}
+
+// hasTLS returns true, if any TLS option is set.
+func (c ClientConfig) hasTLS() bool {
+	return c.InsecureSkipVerify || c.CACert != "" || c.ClientCert != "" ||
+		c.ServerName != "" || c.MinTLSVersion != ""
+}
+
+// tlsVersions maps version strings to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig creates a TLS configuration with custom root certificates, a
+// client certificate, a server name override and a minimum version, if set.
+func NewTLSConfig(c ClientConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+	if c.MinTLSVersion != "" {
+		v, ok := tlsVersions[c.MinTLSVersion]
+		if !ok {
+			return nil, ErrInvalidTLSVersion
+		}
+		config.MinVersion = v
+	}
+	if c.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CACert)
+		}
+		config.RootCAs = pool
+	}
+	if c.ClientCert != "" {
+		key := c.ClientKey
+		if key == "" {
+			key = c.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// proxyFunc returns the proxy function for a transport. An explicit proxy is
+// used for both http and https requests, respecting NO_PROXY.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxy, proxy)
+	}
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+// bypassProxy reports whether a URL is connected to directly, like with
+// http.ProxyFromEnvironment: localhost and loopback addresses always are,
+// other hosts if they match a comma separated NO_PROXY entry. Entries are *,
+// IP addresses, CIDR ranges or domain names, which match the domain and its
+// subdomains, or only the subdomains with a leading dot. Entries other than
+// ranges may have a port.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		entry = strings.Trim(entry, "[]")
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+			continue
+		}
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHTTPClient creates a pester client from a configuration.
+func NewHTTPClient(c ClientConfig) (*pester.Client, error) {
+	client := pester.New()
+
+	// Set default timeout if not specified
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+
+	client.Timeout = c.Timeout
+
+	proxy, err := proxyFunc(c.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = proxy
+	if c.hasTLS() {
+		config, err := NewTLSConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = config
+	}
+	var transport http.RoundTripper = t
+	if c.AWSRegion != "" {
+		service := c.AWSService
+		if service == "" {
+			service = "es"
+		}
+		transport, err = newSigV4Transport(transport, c.AWSRegion, service, LoadAWSCredentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	client.EmbedHTTPClient(&http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	})
+
+	return client, nil
+}
+
+// DecodeCloudID returns the elasticsearch endpoint of an Elastic Cloud ID,
+// which has the form "name:base64(host$es_uuid$kibana_uuid)". The port may be
+// given with the host or the elasticsearch id and defaults to 443.
+func DecodeCloudID(id string) (string, error) {
+	_, encoded, ok := strings.Cut(id, ":")
+	if !ok {
+		encoded = id
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidCloudID, err)
+	}
+	parts := strings.Split(strings.TrimSpace(string(b)), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", ErrInvalidCloudID
+	}
+	var (
+		host, port = parts[0], "443"
+		uuid       = parts[1]
+	)
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	if u, p, ok := strings.Cut(uuid, ":"); ok {
+		uuid, port = u, p
+	}
+	return "https://" + uuid + "." + net.JoinHostPort(host, port), nil
+}
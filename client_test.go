@@ -0,0 +1,244 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert creates a self-signed client certificate and key as PEM
+// files and returns their paths along with the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "esbulk-test-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		certFile = filepath.Join(dir, "client.pem")
+		keyFile  = filepath.Join(dir, "client-key.pem")
+	)
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestNewHTTPClientTLS(t *testing.T) {
+	var (
+		dir                     = t.TempDir()
+		certFile, keyFile, cert = writeSelfSignedCert(t, dir)
+		clientCAs               = x509.NewCertPool()
+	)
+	clientCAs.AddCert(cert)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		help   string
+		config ClientConfig
+		ok     bool
+	}{
+		{"no ca", ClientConfig{ClientCert: certFile, ClientKey: keyFile}, false},
+		{"no client cert", ClientConfig{CACert: caFile}, false},
+		{"ca and client cert", ClientConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile}, true},
+		{"server name", ClientConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, ServerName: "example.com"}, true},
+		{"server name mismatch", ClientConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, ServerName: "other.org"}, false},
+		{"min version", ClientConfig{CACert: caFile, ClientCert: certFile, ClientKey: keyFile, MinTLSVersion: "1.3"}, true},
+	}
+	for _, c := range cases {
+		c.config.Timeout = 5 * time.Second
+		client, err := NewHTTPClient(c.config)
+		if err != nil {
+			t.Fatalf("%s: %v", c.help, err)
+		}
+		client.MaxRetries = 1
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got err %v, want ok %v", c.help, err, c.ok)
+		}
+	}
+	if _, err := NewHTTPClient(ClientConfig{MinTLSVersion: "2.0"}); err != ErrInvalidTLSVersion {
+		t.Errorf("got %v, want %v", err, ErrInvalidTLSVersion)
+	}
+}
+
+func TestDecodeCloudID(t *testing.T) {
+	encode := func(s string) string {
+		return "deployment:" + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	var cases = []struct {
+		id   string
+		want string
+		err  error
+	}{
+		{encode("us-east-1.aws.found.io$abc$def"), "https://abc.us-east-1.aws.found.io:443", nil},
+		{encode("us-east-1.aws.found.io:9243$abc$def"), "https://abc.us-east-1.aws.found.io:9243", nil},
+		{encode("us-east-1.aws.found.io$abc:9200$def"), "https://abc.us-east-1.aws.found.io:9200", nil},
+		{encode("us-east-1.aws.found.io"), "", ErrInvalidCloudID},
+		{"deployment:???", "", ErrInvalidCloudID},
+	}
+	for _, c := range cases {
+		got, err := DecodeCloudID(c.id)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%s: got %v, want %v", c.id, err, c.err)
+		}
+		if got != c.want {
+			t.Fatalf("%s: got %s, want %s", c.id, got, c.want)
+		}
+	}
+}
+
+func TestNewHTTPClientProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Host)
+	}))
+	defer proxy.Close()
+	if _, err := NewHTTPClient(ClientConfig{Proxy: "ftp://proxy"}); !errors.Is(err, ErrInvalidProxy) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidProxy)
+	}
+	t.Setenv("NO_PROXY", "direct.invalid")
+	client, err := NewHTTPClient(ClientConfig{Proxy: proxy.URL, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.MaxRetries = 1
+	resp, err := client.Get("http://es.invalid:9200/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get("http://direct.invalid:9200/"); err == nil {
+		t.Fatal("expected direct connection to fail")
+	}
+	if len(proxied) != 1 || proxied[0] != "es.invalid:9200" {
+		t.Fatalf("got %v, want [es.invalid:9200]", proxied)
+	}
+}
+
+func TestBypassProxy(t *testing.T) {
+	noProxy := "direct.invalid, .sub.invalid,10.0.0.0/8,192.168.1.1,port.invalid:8080,[::2]"
+	var cases = []struct {
+		url  string
+		want bool
+	}{
+		{"http://localhost:9200", true},
+		{"http://127.0.0.2:9200", true},
+		{"http://es.invalid:9200", false},
+		{"http://direct.invalid:9200", true},
+		{"http://a.direct.invalid:9200", true},
+		{"http://notdirect.invalid:9200", false},
+		{"http://sub.invalid:9200", false},
+		{"http://a.sub.invalid:9200", true},
+		{"http://10.1.2.3:9200", true},
+		{"http://11.1.2.3:9200", false},
+		{"https://192.168.1.1", true},
+		{"http://port.invalid:8080", true},
+		{"http://port.invalid:9200", false},
+		{"http://[::2]:9200", true},
+		{"http://DIRECT.invalid", true},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassProxy(u, noProxy); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.url, got, c.want)
+		}
+	}
+	u, _ := url.Parse("http://es.invalid:9200")
+	if !bypassProxy(u, "*") {
+		t.Errorf("got false, want true for *")
+	}
+}
+
+func TestOptionsClientError(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer ts.Close()
+	// Without a shared client, one is created from the options. If that fails,
+	// nothing must be sent with a default client instead.
+	for _, options := range []Options{
+		{Servers: []string{ts.URL}, Index: "abc", CACert: filepath.Join(t.TempDir(), "missing.pem")},
+		{Servers: []string{ts.URL}, Index: "abc", Proxy: "ftp://proxy"},
+	} {
+		if err := BulkIndex(t.Context(), []string{`{"a": 1}`}, options); err == nil {
+			t.Fatal("got nil, want client error")
+		}
+		if err := FlushIndex(0, options); err == nil {
+			t.Fatal("got nil, want client error")
+		}
+	}
+	if requests > 0 {
+		t.Fatalf("got %d requests, want none", requests)
+	}
+}
@@ -23,14 +23,19 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"math/rand"
 	"os"
 	"runtime"
 	"strings"
 	"time"
 
+	gzip "github.com/klauspost/pgzip"
 	"github.com/miku/esbulk"
+	"github.com/segmentio/encoding/json"
 )
 
 var (
@@ -43,27 +48,167 @@ var (
 	batchSize          = flag.Int("size", 1000, "bulk batch size")
 	numWorkers         = flag.Int("w", runtime.NumCPU(), "number of workers to use")
 	verbose            = flag.Bool("verbose", false, "output basic progress")
+	logFormat          = flag.String("log-format", "text", "log format: text or json")
+	logBody            = flag.String("log-body", "full", "how to log request bodies and documents on errors: full, none, hash or a maximum number of bytes")
+	logLevel           = flag.String("log-level", "", "log level: debug, info, warn or error (default: info, debug with -verbose)")
 	skipbroken         = flag.Bool("skipbroken", false, "skip broken json")
 	gzipped            = flag.Bool("z", false, "unzip gz'd file on the fly")
 	mapping            = flag.String("mapping", "", "mapping string or filename to apply before indexing")
+	inferMapping       = flag.Int("infer-mapping", 0, "infer a mapping from the first N documents and apply it before indexing")
+	inferNested        = flag.String("infer-nested", "", "comma separated fields, whose arrays of objects -infer-mapping maps to nested instead of object")
+	cloudID            = flag.String("cloud-id", "", "elastic cloud id of a hosted deployment, instead of -server")
+	compressRequests   = flag.Bool("compress-requests", false, "gzip bulk request bodies")
+	compressLevel      = flag.Int("compress-level", 0, "gzip level for -compress-requests, 1 (fastest) to 9 (best), 0 for default")
+	ordered            = flag.Bool("ordered", false, "send documents with the same id in input order, by assigning each id to a fixed worker (requires -id, not with -transform)")
+	dedup              = flag.String("dedup", "", "send only the first or last occurrence of each id: first or last (requires -id)")
+	dedupDB            = flag.String("dedup-db", "", "keep ids seen for -dedup in this file instead of memory")
 	config             = flag.String("c", "", "create index mappings, settings, aliases, https://is.gd/3zszeu")
 	purge              = flag.Bool("purge", false, "purge any existing index before indexing")
 	purgePause         = flag.Duration("purge-pause", 1*time.Second, "pause after purge")
 	idfield            = flag.String("id", "", "name of field to use as id field, by default ids are autogenerated")
-	user               = flag.String("u", "", "http basic auth username:password, like curl -u")
-	apiKey             = flag.String("apikey", "", "set the encoded ES api key (mutually exclusive with -u)")
+	idHash             = flag.String("id-hash", "", "generate ids by hashing the document or the fields given with -id: sha1 or xxhash")
+	include            = flag.String("include", "", "only keep these comma separated fields, with dots for nested fields, like a,b.c")
+	exclude            = flag.String("exclude", "", "remove these comma separated fields, with dots for nested fields, like a,b.c")
+	transformScript    = flag.String("transform", "", "JavaScript file with a function transform(doc), returning a document, an array of documents or null")
+	transformTimeout   = flag.Duration("transform-timeout", 10*time.Second, "maximum time for -transform to handle a document")
+	user               = flag.String("u", "", "http basic auth username:password, like curl -u, or @file to read it from a file (default: $ESBULK_USER, $ESBULK_PASSWORD or netrc)")
+	apiKey             = flag.String("apikey", "", "set the encoded ES api key, or @file to read it from a file, mutually exclusive with -u (default: $ESBULK_APIKEY)")
+	bearerToken        = flag.String("bearer", "", "bearer token, or @file to read it from a file, reread every minute")
+	netrcFile          = flag.String("netrc", "", "netrc file to look up credentials for the server host (default: $NETRC or ~/.netrc)")
 	zeroReplica        = flag.Bool("0", false, "set the number of replicas to 0 during indexing")
 	refreshInterval    = flag.String("r", "1s", "Refresh interval after import")
 	pipeline           = flag.String("p", "", "pipeline to use to preprocess documents")
 	insecureSkipVerify = flag.Bool("k", false, "skip insecure certificate verification")
+	caCert             = flag.String("cacert", "", "PEM file with CA certificates to trust, in addition to the system pool")
+	clientCert         = flag.String("cert", "", "PEM file with a client certificate for mutual TLS")
+	clientKey          = flag.String("key", "", "PEM file with the private key for -cert, if not contained in it")
+	tlsServerName      = flag.String("tls-server-name", "", "server name to verify the server certificate against")
+	tlsMinVersion      = flag.String("tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	awsRegion          = flag.String("aws-sigv4", "", "sign requests with AWS signature version 4 for this region, e.g. eu-central-1")
+	awsService         = flag.String("aws-service", "es", "AWS service name used for signing, es or aoss for serverless")
+	proxy              = flag.String("proxy", "", "http, https or socks5 proxy URL, respects NO_PROXY (default: $HTTP_PROXY, $HTTPS_PROXY)")
 	requestTimeout     = flag.Duration("timeout", 30*time.Second, "timeout for HTTP requests")
+	syncFile           = flag.String("sync", "", "keep document hashes in this file and only send new or changed documents, delete missing ones (requires -id)")
+	dryRun             = flag.Bool("dry-run", false, "read and prepare all documents, but only print the planned operations")
+	dryRunSamples      = flag.String("dry-run-samples", "", "file to write sample bulk request bodies to in a dry run (default: temporary file)")
+	metricsAddr        = flag.String("metrics-addr", "", "serve prometheus metrics on this address during the run, e.g. :9100")
+	progress           = flag.Bool("progress", false, "show progress, with percent complete and ETA for regular files")
+	stateFile          = flag.String("state-file", "", "file to record index settings to restore in (default: user cache dir)")
+	restoreOnly        = flag.Bool("restore-only", false, "do not index, only set the refresh interval (-r) of the index and flush it, e.g. after a crash")
+	reportFile         = flag.String("report", "", "write a JSON summary of the run to this file")
+	serverSelection    = flag.String("server-selection", "round-robin", "how to pick a server for a request: round-robin or least-in-flight")
+	sniff              = flag.Bool("sniff", false, "discover cluster nodes at startup and periodically, and spread requests across them")
+	sniffInterval      = flag.Duration("sniff-interval", 5*time.Minute, "interval for -sniff")
+	sniffRoles         = flag.String("sniff-roles", "data,ingest", "comma separated node roles to send requests to with -sniff")
 	serverFlags        esbulk.ArrayFlags
-	seed               = flag.Int64("seed", 0, "seed for random server selection (default: current unix nano)")
+	headerFlags        esbulk.ArrayFlags
+	renameFlags        esbulk.ArrayFlags
+	setFlags           esbulk.ArrayFlags
+	defaultFlags       esbulk.ArrayFlags
+	seed               = flag.Int64("seed", 0, "seed for picking a server at random, where -server-selection does not apply (default: current unix nano)")
 )
 
+// newLogger creates a logger writing to stderr in the given format. Without
+// an explicit level, verbose enables debug messages.
+func newLogger(format, level string, verbose bool) (*slog.Logger, error) {
+	var lvl slog.Level
+	switch {
+	case level != "":
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level: %s", level)
+		}
+	case verbose:
+		lvl = slog.LevelDebug
+	default:
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+}
+
+// inferMappingCommand implements the infer-mapping subcommand, which prints a
+// mapping inferred from a sample of documents.
+func inferMappingCommand(args []string) {
+	var (
+		fs                 = flag.NewFlagSet("infer-mapping", flag.ExitOnError)
+		sample             = fs.Int("n", 1000, "number of documents to sample, 0 means all")
+		gzipped            = fs.Bool("z", false, "unzip gz'd file on the fly")
+		asConfig           = fs.Bool("c", false, "wrap mapping into an index config, as used with esbulk -c")
+		nested             = fs.String("nested", "", "comma separated fields, whose arrays of objects are mapped to nested instead of object")
+		reader   io.Reader = os.Stdin
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: esbulk infer-mapping [options] [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		reader = f
+	}
+	if *gzipped {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		reader = zr
+	}
+	inferred, err := esbulk.InferMapping(reader, *sample, *nested)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, c := range inferred.Conflicts {
+		log.Printf("conflict: %s", c)
+	}
+	var v any = inferred.Mapping
+	if *asConfig {
+		v = inferred.Config()
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(b))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "infer-mapping" {
+		inferMappingCommand(os.Args[2:])
+		return
+	}
+	// The restore-settings subcommand takes the same options as indexing,
+	// e.g. for authentication, and the state file as argument.
+	var restoreSettings bool
+	if len(os.Args) > 1 && os.Args[1] == "restore-settings" {
+		restoreSettings = true
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Var(&serverFlags, "server", "elasticsearch server, this works with https as well")
+	flag.Var(&headerFlags, "H", "extra header to send with every request, like curl -H \"X-Tenant: foo\"")
+	flag.Var(&renameFlags, "rename", "rename a top level field, as old:new, can be repeated")
+	flag.Var(&setFlags, "set", "set a top level field, as field=value, with {{now}}, {{file}}, {{line}} or {{env:NAME}} in values, can be repeated")
+	flag.Var(&defaultFlags, "default", "set a top level field, if missing or null, as field=value, like -set, can be repeated")
 	flag.Parse()
+	if restoreSettings && flag.NArg() > 0 {
+		*stateFile = flag.Arg(0)
+	}
+
+	logger, err := newLogger(*logFormat, *logLevel, *verbose)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
 
 	// Seed the random generator. If seed is 0, use current unix nano time.
 	seedValue := *seed
@@ -75,7 +220,7 @@ func main() {
 		file               *os.File = os.Stdin
 		username, password string
 	)
-	if flag.NArg() > 0 {
+	if flag.NArg() > 0 && !restoreSettings {
 		f, err := os.Open(flag.Arg(0))
 		if err != nil {
 			log.Fatalln(err)
@@ -84,43 +229,87 @@ func main() {
 		file = f
 	}
 	if len(*user) > 0 {
-		parts := strings.Split(*user, ":")
-		if len(parts) != 2 {
-			log.Fatal("http basic auth syntax is: username:password")
+		username, password, err = esbulk.ParseUserInfo(*user)
+		if err != nil {
+			log.Fatal(err)
 		}
-		username = parts[0]
-		password = parts[1]
 	}
 	if len(*apiKey) > 0 && len(*user) > 0 {
-		log.Fatal("username:password and apikey cannot be used simultaneously")
+		log.Fatal(esbulk.ErrCredentialConflict)
+	}
+	key, err := esbulk.ReadSecret(*apiKey)
+	if err != nil {
+		log.Fatal(err)
 	}
 	runner := &esbulk.Runner{
-		ApiKey:             *apiKey,
+		ApiKey:             key,
+		AWSRegion:          *awsRegion,
+		AWSService:         *awsService,
 		BatchSize:          *batchSize,
+		BearerToken:        *bearerToken,
+		CloudID:            *cloudID,
+		CompressLevel:      *compressLevel,
+		CompressRequests:   *compressRequests,
 		Config:             *config,
 		CpuProfile:         *cpuprofile,
+		Dedup:              *dedup,
+		DedupDB:            *dedupDB,
+		DefaultFields:      defaultFlags,
 		DocType:            *docType,
+		Exclude:            *exclude,
+		DryRun:             *dryRun,
+		DryRunSamples:      *dryRunSamples,
 		File:               file,
 		FileGzipped:        *gzipped,
+		Headers:            headerFlags,
 		IdentifierField:    *idfield,
+		IDHash:             *idHash,
+		Include:            *include,
 		IndexName:          *indexName,
+		InferMapping:       *inferMapping,
+		InferNested:        *inferNested,
 		Mapping:            *mapping,
 		MemProfile:         *memprofile,
+		MetricsAddr:        *metricsAddr,
+		NetrcFile:          *netrcFile,
 		NumWorkers:         *numWorkers,
 		OpType:             *opType,
+		Ordered:            *ordered,
 		Password:           password,
 		Pipeline:           *pipeline,
+		Progress:           *progress,
+		Proxy:              *proxy,
 		Purge:              *purge,
 		PurgePause:         *purgePause,
 		RefreshInterval:    *refreshInterval,
+		RenameFields:       renameFlags,
+		ReportFile:         *reportFile,
+		RestoreOnly:        *restoreOnly,
+		RestoreSettings:    restoreSettings,
 		RequestTimeout:     *requestTimeout,
 		Servers:            serverFlags,
+		ServerSelection:    *serverSelection,
+		SetFields:          setFlags,
 		ShowVersion:        *version,
 		SkipBroken:         *skipbroken,
+		StateFile:          *stateFile,
+		Sniff:              *sniff,
+		SniffInterval:      *sniffInterval,
+		SniffRoles:         strings.FieldsFunc(*sniffRoles, func(r rune) bool { return r == ',' || r == ' ' }),
+		SyncFile:           *syncFile,
+		TransformScript:    *transformScript,
+		TransformTimeout:   *transformTimeout,
 		Username:           username,
 		Verbose:            *verbose,
+		Logger:             logger,
+		LogBody:            *logBody,
 		ZeroReplica:        *zeroReplica,
 		InsecureSkipVerify: *insecureSkipVerify,
+		CACert:             *caCert,
+		ClientCert:         *clientCert,
+		ClientKey:          *clientKey,
+		TLSServerName:      *tlsServerName,
+		TLSMinVersion:      *tlsMinVersion,
 	}
 	if err := runner.Run(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,75 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"sync"
+)
+
+// ErrInvalidCompressLevel is returned for a gzip level outside 1 to 9.
+var ErrInvalidCompressLevel = errors.New("compression level must be between 1 and 9")
+
+// gzipWriters pools compressors per level, indexed by level, since a gzip
+// writer allocates several hundred kilobytes of state.
+var gzipWriters [gzip.BestCompression + 1]sync.Pool
+
+// validCompressLevel returns an error for an unsupported level; zero means
+// the default level.
+func validCompressLevel(level int) error {
+	if level < 0 || level > gzip.BestCompression {
+		return ErrInvalidCompressLevel
+	}
+	return nil
+}
+
+// compressBody gzips a request body at a given level, reusing compressors
+// across batches. A zero level means the default compression.
+func compressBody(body string, level int) ([]byte, error) {
+	if err := validCompressLevel(level); err != nil {
+		return nil, err
+	}
+	if level == 0 {
+		level = 6 // what gzip.DefaultCompression resolves to
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(body) / 4)
+	zw, ok := gzipWriters[level].Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(&buf)
+	} else {
+		var err error
+		if zw, err = gzip.NewWriterLevel(&buf, level); err != nil {
+			return nil, err
+		}
+	}
+	defer gzipWriters[level].Put(zw)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompressRequests(t *testing.T) {
+	var (
+		fake    = &fakeBulkServer{}
+		ts      = httptest.NewServer(fake)
+		stats   = NewStats()
+		options = Options{
+			Servers:          []string{ts.URL},
+			Index:            "test",
+			OpType:           "index",
+			BatchSize:        10,
+			IDField:          "id",
+			CompressRequests: true,
+			Stats:            stats,
+		}
+		docs []string
+	)
+	defer ts.Close()
+	for i := 0; i < 100; i++ {
+		docs = append(docs, fmt.Sprintf(`{"id": "%d", "v": "the same text over and over"}`, i))
+	}
+	if err := BulkIndex(context.Background(), docs, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.reset(); len(got) != 100 {
+		t.Fatalf("got %d items, want 100", len(got))
+	}
+	report := stats.Report()
+	if report.BytesSent == 0 || report.BytesSent*4 > report.Bytes {
+		t.Fatalf("got %d bytes sent for %d bytes, want compression", report.BytesSent, report.Bytes)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidUserInfo    = errors.New("http basic auth syntax is: username:password")
+	ErrCredentialConflict = errors.New("only one of username:password, apikey and bearer token can be used")
+)
+
+// ReadSecret returns s, or if s starts with @, the contents of the named file
+// with surrounding whitespace removed. This keeps secrets out of the shell
+// history and the process list.
+func ReadSecret(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	b, err := os.ReadFile(s[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// ParseUserInfo parses "username:password", like curl -u. The password may
+// contain colons. A value starting with @ is read from a file first.
+func ParseUserInfo(s string) (username, password string, err error) {
+	if s, err = ReadSecret(s); err != nil {
+		return "", "", err
+	}
+	username, password, ok := strings.Cut(s, ":")
+	if !ok || username == "" {
+		return "", "", ErrInvalidUserInfo
+	}
+	return username, password, nil
+}
+
+// NetrcCredentials looks up login and password for a host in a netrc file.
+// Only an entry for the exact machine name matches; a default entry is
+// ignored, so that its credentials are not sent to arbitrary servers.
+func NetrcCredentials(filename, host string) (login, password string, ok bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer f.Close()
+	type entry struct {
+		login, password string
+	}
+	var (
+		current *entry
+		found   *entry
+		scanner = bufio.NewScanner(f)
+		inMacro bool
+		tokens  []string
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro definition ends with an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if fields[i] == "macdef" {
+				inMacro = true
+				break
+			}
+			tokens = append(tokens, fields[i])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", false, err
+	}
+	for i := 0; i < len(tokens); i++ {
+		var next string
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+		switch tokens[i] {
+		case "machine":
+			current = &entry{}
+			if next == host && found == nil {
+				found = current
+			}
+			i++
+		case "default":
+			current = &entry{}
+		case "login":
+			if current != nil {
+				current.login = next
+			}
+			i++
+		case "password":
+			if current != nil {
+				current.password = next
+			}
+			i++
+		case "account":
+			i++
+		}
+	}
+	if found == nil {
+		return "", "", false, nil
+	}
+	return found.login, found.password, true, nil
+}
+
+// defaultNetrcFile returns the path of the netrc file, honoring $NETRC.
+func defaultNetrcFile() string {
+	if s := os.Getenv("NETRC"); s != "" {
+		return s
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// resolveCredentials fills in credentials, that were not given explicitly,
+// from the environment (ESBULK_USER, ESBULK_PASSWORD, ESBULK_APIKEY) or from
+// the netrc entry matching one of the servers.
+func (r *Runner) resolveCredentials() error {
+	var explicit int
+	for _, s := range []string{r.Username, r.ApiKey, r.BearerToken} {
+		if s != "" {
+			explicit++
+		}
+	}
+	if explicit > 1 {
+		return ErrCredentialConflict
+	}
+	if explicit == 1 {
+		return nil
+	}
+	var (
+		user   = os.Getenv("ESBULK_USER")
+		apiKey = os.Getenv("ESBULK_APIKEY")
+	)
+	switch {
+	case user != "" && apiKey != "":
+		return ErrCredentialConflict
+	case user != "":
+		r.Username, r.Password = user, os.Getenv("ESBULK_PASSWORD")
+		return nil
+	case apiKey != "":
+		r.ApiKey = apiKey
+		return nil
+	}
+	filename := r.NetrcFile
+	if filename == "" {
+		if filename = defaultNetrcFile(); filename == "" {
+			return nil
+		}
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	for _, server := range r.Servers {
+		u, err := url.Parse(server)
+		if err != nil {
+			continue
+		}
+		login, password, ok, err := NetrcCredentials(filename, u.Hostname())
+		if err != nil {
+			return fmt.Errorf("failed to read netrc: %w", err)
+		}
+		if ok {
+			r.Username, r.Password = login, password
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUserInfo(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("admin:pa:ss\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		s        string
+		username string
+		password string
+		err      error
+	}{
+		{"user:pass", "user", "pass", nil},
+		{"user:pa:ss", "user", "pa:ss", nil},
+		{"user:", "user", "", nil},
+		{"user", "", "", ErrInvalidUserInfo},
+		{":pass", "", "", ErrInvalidUserInfo},
+		{"@" + secret, "admin", "pa:ss", nil},
+	}
+	for _, c := range cases {
+		username, password, err := ParseUserInfo(c.s)
+		if err != c.err || username != c.username || password != c.password {
+			t.Errorf("ParseUserInfo(%q) got %q, %q, %v, want %q, %q, %v",
+				c.s, username, password, err, c.username, c.password, c.err)
+		}
+	}
+}
+
+func TestNetrcCredentials(t *testing.T) {
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	data := `# comment
+machine other.example.com login a password b
+macdef init
+	cd /pub
+
+machine es.example.com
+	login esuser
+	password x:y
+default login anon password guest
+`
+	if err := os.WriteFile(netrc, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		host     string
+		login    string
+		password string
+	}{
+		{"es.example.com", "esuser", "x:y"},
+		{"other.example.com", "a", "b"},
+	}
+	for _, c := range cases {
+		login, password, ok, err := NetrcCredentials(netrc, c.host)
+		if err != nil || !ok || login != c.login || password != c.password {
+			t.Errorf("%s: got %q, %q, %v, %v", c.host, login, password, ok, err)
+		}
+	}
+	// The default entry is not used for other hosts.
+	if login, password, ok, err := NetrcCredentials(netrc, "unknown.example.com"); err != nil || ok || login != "" || password != "" {
+		t.Errorf("got %q, %q, %v, %v, want no credentials", login, password, ok, err)
+	}
+}
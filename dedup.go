@@ -0,0 +1,273 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Deduplication modes.
+const (
+	DedupFirst = "first"
+	DedupLast  = "last"
+)
+
+var (
+	ErrInvalidDedup    = errors.New("dedup must be first or last")
+	ErrDedupRequiresID = errors.New("dedup requires an id field")
+
+	dedupBucket = []byte("ids")
+)
+
+// dedupFlushSize is the number of entries buffered in memory before they are
+// written to a dedup database.
+const dedupFlushSize = 100000
+
+// dedupIndex keeps track of document IDs seen in a run, either in memory or
+// in a bolt database, to only let the first or last occurrence of every ID
+// through. IDs are kept as they are, so distinct IDs never collide. For the
+// last occurrence, the input is scanned once beforehand, to record a hash of
+// the last version of each document.
+type dedupIndex struct {
+	mode    string
+	options Options           // for document IDs
+	mem     map[string]uint64 // all entries, or those not yet written to db
+	db      *bolt.DB
+}
+
+// openDedupIndex creates an index in memory or, if a filename is given, in a
+// bolt database, starting from scratch.
+func openDedupIndex(mode string, options Options, filename string) (*dedupIndex, error) {
+	d := &dedupIndex{mode: mode, options: options, mem: make(map[string]uint64)}
+	if filename == "" {
+		return d, nil
+	}
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(dedupBucket); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		_, err := tx.CreateBucket(dedupBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	d.db = db
+	return d, nil
+}
+
+// Close writes pending entries and closes the database, if any.
+func (d *dedupIndex) Close() error {
+	if d.db == nil {
+		return nil
+	}
+	return errors.Join(d.flush(), d.db.Close())
+}
+
+func (d *dedupIndex) get(k string) (uint64, bool, error) {
+	if v, ok := d.mem[k]; ok || d.db == nil {
+		return v, ok, nil
+	}
+	var (
+		v     uint64
+		found bool
+	)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(dedupBucket).Get([]byte(k)); b != nil {
+			v, found = binary.BigEndian.Uint64(b), true
+		}
+		return nil
+	})
+	return v, found, err
+}
+
+func (d *dedupIndex) put(k string, v uint64) error {
+	d.mem[k] = v
+	if d.db != nil && len(d.mem) >= dedupFlushSize {
+		return d.flush()
+	}
+	return nil
+}
+
+// flush writes buffered entries to the database.
+func (d *dedupIndex) flush() error {
+	err := d.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(dedupBucket)
+		for k, v := range d.mem {
+			if err := b.Put([]byte(k), binary.BigEndian.AppendUint64(nil, v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		clear(d.mem)
+	}
+	return err
+}
+
+// docHash returns a non-zero hash of a document; zero marks IDs, whose last
+// version has already been let through.
+func docHash(doc string) uint64 {
+	if h := xxhash.Sum64String(doc); h != 0 {
+		return h
+	}
+	return 1
+}
+
+// record notes a document as the last version seen so far for its ID. The
+// version is the input line, which the document may have been edited from.
+func (d *dedupIndex) record(doc, version string) error {
+	id, _, err := documentID(doc, d.options)
+	if err != nil || id == "" {
+		return nil // reported, when the document is indexed
+	}
+	return d.put(id, docHash(version))
+}
+
+// keep returns true, if the document is the occurrence of its ID to send.
+// Documents without a valid ID are kept, so they fail as usual.
+func (d *dedupIndex) keep(doc, version string) (bool, error) {
+	id, _, err := documentID(doc, d.options)
+	if err != nil || id == "" {
+		return true, nil
+	}
+	v, found, err := d.get(id)
+	if err != nil {
+		return false, err
+	}
+	switch d.mode {
+	case DedupFirst:
+		if found {
+			return false, nil
+		}
+		return true, d.put(id, 1)
+	default:
+		if found && v != docHash(version) {
+			return false, nil // a later version wins, or it was already sent
+		}
+		return true, d.put(id, 0)
+	}
+}
+
+// openDedup sets up deduplication for the run. To keep the last occurrence,
+// the input is read once to find the last versions and then rewound. Input
+// that cannot be rewound, like standard input, is spooled to a temporary
+// file first.
+func (r *Runner) openDedup(options Options) error {
+	d, err := openDedupIndex(r.Dedup, options, r.DedupDB)
+	if err != nil {
+		return fmt.Errorf("failed to open dedup index: %w", err)
+	}
+	r.dedup = d
+	if r.Dedup != DedupLast {
+		return nil
+	}
+	reader, err := r.input()
+	if err != nil {
+		return err
+	}
+	var spool *os.File
+	if fi, err := r.File.Stat(); err != nil || !fi.Mode().IsRegular() {
+		if spool, err = os.CreateTemp("", "esbulk-dedup-*.ldj"); err != nil {
+			return err
+		}
+		os.Remove(spool.Name()) // unlinked, removed once closed
+	}
+	r.log().Info("scanning input for duplicates", "index", r.IndexName, "spool", spool != nil)
+	var w *bufio.Writer
+	if spool != nil {
+		w = bufio.NewWriter(spool)
+	}
+	for _, line := range r.sampled {
+		if w != nil {
+			if _, err := w.WriteString(line + "\n"); err != nil {
+				return err
+			}
+		}
+		if err := r.recordDedup(line); err != nil {
+			return err
+		}
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if w != nil && len(line) > 0 {
+			if _, werr := w.WriteString(line); werr != nil {
+				return werr
+			}
+		}
+		if doc := strings.TrimSpace(line); doc != "" {
+			if rerr := r.recordDedup(doc); rerr != nil {
+				return rerr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Start over, from the spooled input or from the beginning of the file.
+	if w != nil {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		r.File, r.FileGzipped = spool, false
+	}
+	if _, err := r.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.reader, r.sampled, r.sampledLines = nil, nil, nil
+	r.stats.BytesRead.Store(0)
+	return nil
+}
+
+// recordDedup records an input line for -dedup last, with the ID read after
+// field edits, like when the line is read again. IDs never depend on the line
+// number, which is not tracked here.
+func (r *Runner) recordDedup(line string) error {
+	doc := line
+	if r.editor != nil {
+		edited, err := r.editor.Edit(line, 0)
+		if err != nil {
+			return nil // reported, when the line is read again
+		}
+		doc = edited
+	}
+	return r.dedup.record(doc, line)
+}
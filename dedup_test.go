@@ -0,0 +1,163 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDedupIndex(t *testing.T) {
+	docs := []string{
+		`{"id": "1", "v": "a"}`,
+		`{"id": "2", "v": "b"}`,
+		`{"id": "1", "v": "c"}`,
+		`{"id": "3", "v": "d"}`,
+		`{"id": "1", "v": "c"}`,
+		`broken`,
+	}
+	var cases = []struct {
+		mode string
+		db   bool
+		want []string
+	}{
+		{DedupFirst, false, []string{docs[0], docs[1], docs[3], docs[5]}},
+		{DedupLast, false, []string{docs[1], docs[2], docs[3], docs[5]}},
+		{DedupLast, true, []string{docs[1], docs[2], docs[3], docs[5]}},
+	}
+	for _, c := range cases {
+		var filename string
+		if c.db {
+			filename = filepath.Join(t.TempDir(), "dedup.db")
+		}
+		d, err := openDedupIndex(c.mode, Options{IDField: "id"}, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.mode == DedupLast {
+			for _, doc := range docs {
+				if err := d.record(doc, doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if c.db {
+				if err := d.flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		var got []string
+		for _, doc := range docs {
+			keep, err := d.keep(doc, doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keep {
+				got = append(got, doc)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s (db: %v): got %v, want %v", c.mode, c.db, got, c.want)
+		}
+	}
+}
+
+func TestRunDedupLastFromPipe(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(pw, `{"id": "%d", "v": %d}`+"\n", i%4, i)
+		}
+		pw.Close()
+	}()
+	r := &Runner{
+		Servers:         []string{ts.URL},
+		BatchSize:       3,
+		NumWorkers:      2,
+		RefreshInterval: "1s",
+		IndexName:       "abc",
+		IdentifierField: "id",
+		Dedup:           DedupLast,
+		File:            pr,
+		StateFile:       filepath.Join(t.TempDir(), "state.json"),
+	}
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got := cluster.reset()
+	sort.Strings(got)
+	if want := []string{"index 0", "index 1", "index 2", "index 3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if n := r.stats.Duplicates.Load(); n != 6 {
+		t.Fatalf("got %d duplicates, want 6", n)
+	}
+}
+
+func TestRunDedupBeforeSettings(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	f, err := os.CreateTemp(t.TempDir(), "docs-*.ldj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintln(f, `{"id": "1"}`)
+	f.Seek(0, io.SeekStart)
+	r := &Runner{
+		Servers:         []string{ts.URL},
+		BatchSize:       3,
+		NumWorkers:      2,
+		RefreshInterval: "1s",
+		IndexName:       "abc",
+		IdentifierField: "id",
+		Dedup:           DedupLast,
+		DedupDB:         filepath.Join(t.TempDir(), "missing", "dedup.db"),
+		File:            f,
+		StateFile:       filepath.Join(t.TempDir(), "state.json"),
+	}
+	if err := r.Run(); err == nil {
+		t.Fatal("expected error for unusable dedup db")
+	}
+	for _, req := range cluster.requests {
+		if strings.Contains(req, "_settings") {
+			t.Fatalf("settings touched before dedup failed: %v", cluster.requests)
+		}
+	}
+}
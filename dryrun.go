@@ -0,0 +1,234 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	// maxPlanSamples is the number of bulk request bodies written to the
+	// samples file during a dry run.
+	maxPlanSamples = 3
+	// maxPlanFailures is the number of failed documents reported in a plan.
+	maxPlanFailures = 20
+	// maxPlanFailureLength truncates the error message of a failed document.
+	maxPlanFailureLength = 256
+)
+
+// Plan collects the operations of a dry run. When set in Options, bulk
+// requests are built as usual, but recorded instead of sent.
+type Plan struct {
+	mu         sync.Mutex
+	ops        []string
+	docs       int64
+	batches    int64
+	bytes      int64
+	failed     int64
+	failures   []string
+	samples    *os.File
+	numSamples int
+}
+
+// NewPlan creates a new plan, that writes sample bulk request bodies to the
+// given file. If filename is empty, a temporary file is used.
+func NewPlan(filename string) (*Plan, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if filename == "" {
+		f, err = os.CreateTemp("", "esbulk-dry-run-*.ndjson")
+	} else {
+		f, err = os.Create(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{samples: f}, nil
+}
+
+// Close closes the samples file.
+func (p *Plan) Close() error {
+	return p.samples.Close()
+}
+
+// Add records a planned operation.
+func (p *Plan) Add(format string, a ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ops = append(p.ops, fmt.Sprintf(format, a...))
+}
+
+// recordBatch records a bulk request with a given number of documents.
+func (p *Plan) recordBatch(numDocs int, body string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.docs += int64(numDocs)
+	p.batches++
+	p.bytes += int64(len(body))
+	if p.numSamples < maxPlanSamples {
+		p.numSamples++
+		if _, err := io.WriteString(p.samples, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordFailure records a document that would fail, e.g. because it has no ID.
+func (p *Plan) recordFailure(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed++
+	if len(p.failures) < maxPlanFailures {
+		msg := err.Error()
+		if len(msg) > maxPlanFailureLength {
+			msg = msg[:maxPlanFailureLength] + "..."
+		}
+		p.failures = append(p.failures, msg)
+	}
+}
+
+// WriteTo writes a human readable summary of the plan.
+func (p *Plan) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var (
+		n   int
+		err error
+	)
+	printf := func(format string, a ...any) {
+		if err != nil {
+			return
+		}
+		var k int
+		k, err = fmt.Fprintf(w, format, a...)
+		n += k
+	}
+	printf("dry run, nothing has been sent\n\n")
+	printf("planned operations:\n")
+	for i, op := range p.ops {
+		printf("  %d. %s\n", i+1, op)
+	}
+	printf("\ndocuments: %d\n", p.docs)
+	printf("batches: %d\n", p.batches)
+	printf("bytes: %d\n", p.bytes)
+	printf("failed documents: %d\n", p.failed)
+	for _, msg := range p.failures {
+		printf("  %s\n", msg)
+	}
+	if p.failed > int64(len(p.failures)) {
+		printf("  ... and %d more\n", p.failed-int64(len(p.failures)))
+	}
+	printf("sample bulk bodies (%d): %s\n", p.numSamples, p.samples.Name())
+	return int64(n), err
+}
+
+// planSetup records the index operations a run would perform around loading
+// the documents, and checks that the configuration and mapping are valid.
+func (r *Runner) planSetup(plan *Plan, options Options) error {
+	if r.Purge {
+		plan.Add("delete index %s, then pause for %s", options.Index, r.PurgePause)
+		if r.SyncFile != "" {
+			plan.Add("forget all documents in %s", r.SyncFile)
+		}
+	}
+	if r.Config != "" {
+		b, err := readStringOrFile(r.Config)
+		if err != nil {
+			return err
+		}
+		var config struct {
+			Settings map[string]any `json:"settings"`
+			Mappings map[string]any `json:"mappings"`
+			Aliases  map[string]any `json:"aliases"`
+		}
+		if err := json.Unmarshal(b, &config); err != nil {
+			return fmt.Errorf("invalid index config: %w", err)
+		}
+		plan.Add("create index %s, if it does not exist, with config (%d bytes, %d settings, %d mappings)",
+			options.Index, len(b), len(config.Settings), len(config.Mappings))
+		var aliases []string
+		for name := range config.Aliases {
+			aliases = append(aliases, name)
+		}
+		sort.Strings(aliases)
+		for _, name := range aliases {
+			plan.Add("add alias %s to index %s", name, options.Index)
+		}
+	} else {
+		plan.Add("create index %s, if it does not exist", options.Index)
+	}
+	if r.Mapping != "" {
+		b, err := readStringOrFile(r.Mapping)
+		if err != nil {
+			return err
+		}
+		if !json.Valid(b) {
+			return fmt.Errorf("invalid mapping: %s", r.Mapping)
+		}
+		plan.Add("put mapping (%d bytes)", len(b))
+	} else if r.InferMapping > 0 {
+		inferred, err := r.inferMapping(options)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(inferred.Mapping)
+		if err != nil {
+			return err
+		}
+		plan.Add("put mapping inferred from %d documents (%d bytes, %d conflicts): %s",
+			inferred.NumDocs, len(b), len(inferred.Conflicts), string(b))
+	}
+	plan.Add("write settings to restore to %s", r.stateFile())
+	plan.Add("set refresh_interval of %s to -1", options.Index)
+	if r.ZeroReplica {
+		plan.Add("set number_of_replicas of %s to 0", options.Index)
+	}
+	plan.Add("%s documents with %d workers and batch size %d", options.OpType, r.NumWorkers, options.BatchSize)
+	if r.SyncFile != "" {
+		plan.Add("sync with %s, but all documents are planned, since the store is not consulted in a dry run", r.SyncFile)
+	}
+	plan.Add("set refresh_interval of %s to %s", options.Index, r.RefreshInterval)
+	if r.ZeroReplica {
+		plan.Add("set number_of_replicas of %s back to its original value", options.Index)
+	}
+	plan.Add("flush index %s", options.Index)
+	plan.Add("remove %s", r.stateFile())
+	return nil
+}
+
+// readStringOrFile returns the contents of the named file or, if no such file
+// exists, the string itself.
+func readStringOrFile(s string) ([]byte, error) {
+	if _, err := os.Stat(s); os.IsNotExist(err) {
+		return []byte(s), nil
+	}
+	return os.ReadFile(s)
+}
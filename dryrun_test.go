@@ -0,0 +1,112 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDryRun(t *testing.T) {
+	var (
+		cluster = &fakeCluster{index: "abc"}
+		ts      = httptest.NewServer(cluster)
+		dir     = t.TempDir()
+	)
+	defer ts.Close()
+	f, err := os.CreateTemp(dir, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(f, `{"id": %d}`+"\n", i)
+	}
+	fmt.Fprintln(f, `{"noid": 6}`)
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The plan is printed to standard output.
+	out, err := os.Create(filepath.Join(dir, "plan.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	r := &Runner{
+		Servers:         []string{ts.URL},
+		BatchSize:       2,
+		NumWorkers:      1,
+		RefreshInterval: "1s",
+		IndexName:       "abc",
+		IdentifierField: "id",
+		Mapping:         `{"properties": {"id": {"type": "keyword"}}}`,
+		ZeroReplica:     true,
+		OpType:          "index",
+		File:            f,
+		DryRun:          true,
+		DryRunSamples:   filepath.Join(dir, "samples.ndjson"),
+		StateFile:       filepath.Join(dir, "state.json"),
+	}
+	err = r.Run()
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster.requests) > 0 || len(cluster.reset()) > 0 {
+		t.Fatalf("got requests %v, want none in a dry run", cluster.requests)
+	}
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := string(b)
+	for _, want := range []string{
+		"dry run, nothing has been sent",
+		"create index abc, if it does not exist",
+		"put mapping (43 bytes)",
+		"set refresh_interval of abc to -1",
+		"set number_of_replicas of abc to 0",
+		"index documents with 1 workers and batch size 2",
+		"set refresh_interval of abc to 1s",
+		"documents: 5\n",
+		"batches: 3\n",
+		"failed documents: 1\n",
+		"document has no ID field (id): {\"noid\": 6}",
+		"flush index abc",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan does not contain %q:\n%s", want, plan)
+		}
+	}
+	samples, err := os.ReadFile(r.DryRunSamples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(samples), "\n"); n != 10 {
+		t.Fatalf("got %d sample lines, want 10", n)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// fakeBulkServer accepts bulk requests and records the action and document ID
+// of every item it receives.
+type fakeBulkServer struct {
+	mu      sync.Mutex
+	actions []string
+	sources []string
+}
+
+func (f *fakeBulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	var (
+		items []map[string]any
+		br    = bufio.NewReader(body)
+	)
+	for {
+		line, err := br.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			var header map[string]map[string]any
+			if jerr := json.Unmarshal([]byte(line), &header); jerr != nil {
+				http.Error(w, jerr.Error(), http.StatusBadRequest)
+				return
+			}
+			for action, meta := range header {
+				f.mu.Lock()
+				f.actions = append(f.actions, fmt.Sprintf("%s %v", action, meta["_id"]))
+				f.mu.Unlock()
+				items = append(items, map[string]any{action: map[string]any{"_id": meta["_id"], "status": 200}})
+				if action != "delete" {
+					source, _ := br.ReadString('\n')
+					f.mu.Lock()
+					f.sources = append(f.sources, strings.TrimSpace(source))
+					f.mu.Unlock()
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"took": 1, "errors": false, "items": items})
+}
+
+// reset returns the recorded actions and forgets all recorded items.
+func (f *fakeBulkServer) reset() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	actions := f.actions
+	f.actions, f.sources = nil, nil
+	return actions
+}
+
+// fakeCluster answers index administration requests for a single index and
+// records them, bulk requests are passed to a fakeBulkServer.
+type fakeCluster struct {
+	fakeBulkServer
+	index    string
+	failPath string // respond with 400 to PUT requests with this body
+	mu       sync.Mutex
+	requests []string
+}
+
+func (c *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_bulk") {
+		c.fakeBulkServer.ServeHTTP(w, r)
+		return
+	}
+	b, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	c.requests = append(c.requests, strings.TrimSpace(fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, b)))
+	c.mu.Unlock()
+	switch {
+	case c.failPath != "" && string(b) == c.failPath:
+		http.Error(w, `{"error": "failed"}`, http.StatusBadRequest)
+	case r.Method == "GET" && r.URL.Path == "/"+c.index+"/_settings":
+		fmt.Fprintf(w, `{%q: {"settings": {"index": {"number_of_replicas": "1", "refresh_interval": "1s"}}}}`, c.index)
+	default:
+		fmt.Fprint(w, `{"acknowledged": true}`)
+	}
+}
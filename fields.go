@@ -0,0 +1,352 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// ErrInvalidFieldSpec is returned for a malformed -rename, -set or -default
+// option.
+var ErrInvalidFieldSpec = errors.New("invalid field spec")
+
+// ErrDynamicFieldConflict is returned, if a field that changes from run to
+// run would be used for an ID hash or a sync hash.
+var ErrDynamicFieldConflict = errors.New("cannot use {{now}} or {{line}} in fields that are hashed")
+
+// placeholderPattern matches placeholders in values, like {{now}}.
+var placeholderPattern = regexp.MustCompile(`{{([^{}]*)}}`)
+
+// fieldValue is a value to set a field to. Values without placeholders are
+// encoded once, the others for every document.
+type fieldValue struct {
+	name     string
+	raw      []byte // encoded value, if constant
+	template string // value with {{now}} or {{line}} placeholders
+	line     bool   // the value is the line number
+}
+
+// encode returns the JSON value for a document at a given line.
+func (v *fieldValue) encode(line int) []byte {
+	switch {
+	case v.raw != nil:
+		return v.raw
+	case v.line:
+		return strconv.AppendInt(nil, int64(line), 10)
+	}
+	s := placeholderPattern.ReplaceAllStringFunc(v.template, func(p string) string {
+		switch p {
+		case "{{now}}":
+			return time.Now().UTC().Format(time.RFC3339)
+		case "{{line}}":
+			return strconv.Itoa(line)
+		}
+		return p
+	})
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// member is a top level member of a document.
+type member struct {
+	key   string
+	value []byte
+}
+
+// FieldEditor renames, sets and defaults top level fields of documents, e.g.
+// to tag every document with its source. The document is not decoded, only
+// split into its top level members, so values are copied as they are.
+type FieldEditor struct {
+	file     string
+	renames  [][2]string
+	sets     []fieldValue
+	defaults []fieldValue
+}
+
+// NewFieldEditor creates an editor for documents read from a file, whose
+// name is available as {{file}} in values.
+func NewFieldEditor(file string) *FieldEditor {
+	return &FieldEditor{file: file}
+}
+
+// Rename adds a rename, given as "old:new". An existing field with the new
+// name is replaced.
+func (e *FieldEditor) Rename(spec string) error {
+	old, name, ok := strings.Cut(spec, ":")
+	if !ok || old == "" || name == "" {
+		return fmt.Errorf("%w: %q, want old:new", ErrInvalidFieldSpec, spec)
+	}
+	e.renames = append(e.renames, [2]string{old, name})
+	return nil
+}
+
+// Set adds a field to set, given as "field=value", replacing any existing
+// value. Values that are valid JSON, like 1, true or {"a": 1}, are used as
+// is, everything else as a string. Values may contain the placeholders
+// {{now}}, {{file}}, {{line}} and {{env:NAME}}.
+func (e *FieldEditor) Set(spec string) error {
+	v, err := e.parseValue(spec)
+	if err != nil {
+		return err
+	}
+	e.sets = append(e.sets, v)
+	return nil
+}
+
+// Default adds a field to set, like Set, but only if the field is missing or
+// null.
+func (e *FieldEditor) Default(spec string) error {
+	v, err := e.parseValue(spec)
+	if err != nil {
+		return err
+	}
+	e.defaults = append(e.defaults, v)
+	return nil
+}
+
+// parseValue parses "field=value", resolving the placeholders that do not
+// change from document to document.
+func (e *FieldEditor) parseValue(spec string) (fieldValue, error) {
+	name, value, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return fieldValue{}, fmt.Errorf("%w: %q, want field=value", ErrInvalidFieldSpec, spec)
+	}
+	v := fieldValue{name: name}
+	if !strings.Contains(value, "{{") {
+		if json.Valid([]byte(value)) {
+			v.raw = []byte(value)
+		} else {
+			v.raw, _ = json.Marshal(value)
+		}
+		return v, nil
+	}
+	var dynamic bool
+	for _, m := range placeholderPattern.FindAllStringSubmatch(value, -1) {
+		switch p := m[1]; {
+		case p == "now" || p == "line":
+			dynamic = true
+		case p == "file":
+		case strings.HasPrefix(p, "env:"):
+		default:
+			return fieldValue{}, fmt.Errorf("%w: unknown placeholder %s in %q", ErrInvalidFieldSpec, m[0], spec)
+		}
+	}
+	value = placeholderPattern.ReplaceAllStringFunc(value, func(p string) string {
+		switch name := p[2 : len(p)-2]; {
+		case name == "file":
+			return e.file
+		case strings.HasPrefix(name, "env:"):
+			return os.Getenv(strings.TrimPrefix(name, "env:"))
+		}
+		return p
+	})
+	switch {
+	case value == "{{line}}":
+		v.line = true
+	case dynamic:
+		v.template = value
+	default:
+		v.raw, _ = json.Marshal(value)
+	}
+	return v, nil
+}
+
+// dynamicFields returns the names of the fields set to values that change
+// from run to run, with {{now}} or {{line}}.
+func (e *FieldEditor) dynamicFields() []string {
+	var names []string
+	for _, v := range append(e.sets[:len(e.sets):len(e.sets)], e.defaults...) {
+		if v.raw == nil {
+			names = append(names, v.name)
+		}
+	}
+	return names
+}
+
+// Edit returns the edited document, found at the given line of the input.
+func (e *FieldEditor) Edit(doc string, line int) (string, error) {
+	members, err := splitMembers([]byte(doc))
+	if err != nil {
+		return "", err
+	}
+	index := func(key string) int {
+		for i, m := range members {
+			if m.key == key {
+				return i
+			}
+		}
+		return -1
+	}
+	for _, r := range e.renames {
+		i := index(r[0])
+		if i < 0 {
+			continue
+		}
+		members[i].key = r[1]
+		for j := range members {
+			if j != i && members[j].key == r[1] {
+				members = append(members[:j], members[j+1:]...)
+				break
+			}
+		}
+	}
+	for _, v := range e.sets {
+		if i := index(v.name); i >= 0 {
+			members[i].value = v.encode(line)
+		} else {
+			members = append(members, member{key: v.name, value: v.encode(line)})
+		}
+	}
+	for _, v := range e.defaults {
+		switch i := index(v.name); {
+		case i < 0:
+			members = append(members, member{key: v.name, value: v.encode(line)})
+		case string(members[i].value) == "null":
+			members[i].value = v.encode(line)
+		}
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(doc))
+	buf.WriteByte('{')
+	for i, m := range members {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(m.key)
+		if err != nil {
+			return "", err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.String(), nil
+}
+
+// splitMembers splits a JSON object into its top level members.
+func splitMembers(b []byte) ([]member, error) {
+	i := skipSpace(b, 0)
+	if i >= len(b) || b[i] != '{' {
+		return nil, ErrInvalidDocument
+	}
+	var members []member
+	i = skipSpace(b, i+1)
+	if i < len(b) && b[i] == '}' {
+		i++
+	} else {
+		for {
+			keyEnd, err := scanString(b, i)
+			if err != nil {
+				return nil, err
+			}
+			key, err := decodeKey(b[i:keyEnd])
+			if err != nil {
+				return nil, err
+			}
+			i = skipSpace(b, keyEnd)
+			if i >= len(b) || b[i] != ':' {
+				return nil, ErrInvalidDocument
+			}
+			i = skipSpace(b, i+1)
+			end, err := scanValue(b, i)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member{key: key, value: b[i:end]})
+			i = skipSpace(b, end)
+			if i >= len(b) {
+				return nil, ErrInvalidDocument
+			}
+			if b[i] == '}' {
+				i++
+				break
+			}
+			if b[i] != ',' {
+				return nil, ErrInvalidDocument
+			}
+			i = skipSpace(b, i+1)
+		}
+	}
+	if skipSpace(b, i) != len(b) {
+		return nil, ErrInvalidDocument
+	}
+	return members, nil
+}
+
+// fieldEditor builds the field editor for a run from its options. It returns
+// nil, if there is nothing to do.
+func (r *Runner) fieldEditor() (*FieldEditor, error) {
+	if len(r.RenameFields) == 0 && len(r.SetFields) == 0 && len(r.DefaultFields) == 0 {
+		return nil, nil
+	}
+	var file string
+	if r.File != nil {
+		file = r.File.Name()
+	}
+	e := NewFieldEditor(file)
+	for _, spec := range r.RenameFields {
+		if err := e.Rename(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range r.SetFields {
+		if err := e.Set(spec); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range r.DefaultFields {
+		if err := e.Default(spec); err != nil {
+			return nil, err
+		}
+	}
+	// Hashes and IDs must not change from run to run, and documents must have
+	// the same ID, whenever they are read.
+	dynamic := e.dynamicFields()
+	if len(dynamic) == 0 {
+		return e, nil
+	}
+	switch {
+	case r.SyncFile != "":
+		return nil, fmt.Errorf("%w: %s, with -sync", ErrDynamicFieldConflict, strings.Join(dynamic, ","))
+	case r.IDHash != "" && r.IdentifierField == "":
+		return nil, fmt.Errorf("%w: %s, with -id-hash", ErrDynamicFieldConflict, strings.Join(dynamic, ","))
+	}
+	for _, field := range strings.FieldsFunc(r.IdentifierField, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name, _, _ := strings.Cut(field, ".")
+		for _, d := range dynamic {
+			if name == d {
+				return nil, fmt.Errorf("%w: %s, used as ID", ErrDynamicFieldConflict, d)
+			}
+		}
+	}
+	return e, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestFieldEditor(t *testing.T) {
+	t.Setenv("ESBULK_TEST_SOURCE", "crossref")
+	var cases = []struct {
+		renames, sets, defaults []string
+		doc                     string
+		want                    string
+	}{
+		{
+			renames: []string{"t:title", "x:y"},
+			doc:     `{"id": 1, "t": "a", "title": "b"}`,
+			want:    `{"id":1,"title":"a"}`,
+		},
+		{
+			sets: []string{"source_id={{env:ESBULK_TEST_SOURCE}}", "n=1", "o={\"a\": [1]}", "s=abc", "id=2"},
+			doc:  `{"id": 1}`,
+			want: `{"id":2,"source_id":"crossref","n":1,"o":{"a": [1]},"s":"abc"}`,
+		},
+		{
+			sets: []string{"line={{line}}", "src={{file}}:{{line}}"},
+			doc:  `{}`,
+			want: `{"line":42,"src":"data.ldj:42"}`,
+		},
+		{
+			renames:  []string{"old:new"},
+			sets:     []string{"a=1"},
+			defaults: []string{"a=2", "b=2", "c=2", "new=2"},
+			doc:      `{"old": 0, "c": null, "d": {"e": null}}`,
+			want:     `{"new":0,"c":2,"d":{"e": null},"a":1,"b":2}`,
+		},
+	}
+	for _, c := range cases {
+		e := NewFieldEditor("data.ldj")
+		for _, spec := range c.renames {
+			if err := e.Rename(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, spec := range c.sets {
+			if err := e.Set(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, spec := range c.defaults {
+			if err := e.Default(spec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := e.Edit(c.doc, 42)
+		if err != nil {
+			t.Fatalf("%s: %v", c.doc, err)
+		}
+		if got != c.want {
+			t.Fatalf("%s: got %s, want %s", c.doc, got, c.want)
+		}
+	}
+	e := NewFieldEditor("")
+	if err := e.Set("indexed_at={{now}}"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.Edit(`{"id": 1}`, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^{"id":1,"indexed_at":"\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ"}$`).MatchString(got) {
+		t.Fatalf("got %s, want current time", got)
+	}
+	for _, spec := range []string{"x", "=1", "x={{today}}"} {
+		if err := e.Set(spec); !errors.Is(err, ErrInvalidFieldSpec) {
+			t.Fatalf("%s: got %v, want %v", spec, err, ErrInvalidFieldSpec)
+		}
+	}
+	if err := e.Rename("x"); !errors.Is(err, ErrInvalidFieldSpec) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidFieldSpec)
+	}
+	if _, err := e.Edit(`[1]`, 1); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidDocument)
+	}
+}
+
+func TestRunnerFieldEditorConflict(t *testing.T) {
+	var cases = []struct {
+		r   Runner
+		err error
+	}{
+		{Runner{IdentifierField: "id", SetFields: []string{"at={{now}}"}}, nil},
+		{Runner{IdentifierField: "id", SyncFile: "sync.db", SetFields: []string{"at=1"}}, nil},
+		{Runner{IdentifierField: "id", SyncFile: "sync.db", SetFields: []string{"at={{now}}"}}, ErrDynamicFieldConflict},
+		{Runner{IDHash: "xxhash", DefaultFields: []string{"n={{line}}"}}, ErrDynamicFieldConflict},
+		{Runner{IDHash: "xxhash", IdentifierField: "title", SetFields: []string{"at={{now}}"}}, nil},
+		{Runner{IDHash: "xxhash", IdentifierField: "title,src.line", SetFields: []string{"src=x:{{line}}"}}, ErrDynamicFieldConflict},
+		{Runner{IdentifierField: "id", SetFields: []string{"id={{line}}"}}, ErrDynamicFieldConflict},
+	}
+	for i, c := range cases {
+		if _, err := c.r.fieldEditor(); !errors.Is(err, c.err) {
+			t.Errorf("[%d] got %v, want %v", i, err, c.err)
+		}
+	}
+}
+
+func TestRunFieldEditorDedup(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	f, err := os.CreateTemp(t.TempDir(), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, `{"other": "1", "id": "x", "n": 1}`)
+	fmt.Fprintln(f, `{"other": "2", "id": "x", "n": 2}`)
+	fmt.Fprintln(f, `{"other": "1", "id": "y", "n": 3}`)
+	// Duplicates are found by the renamed ID, the one that is indexed, also
+	// with values that change every time a line is read.
+	var cases = []struct {
+		dedup string
+		want  []string
+	}{
+		{DedupFirst, []string{"index 1", "index 2"}},
+		{DedupLast, []string{"index 2", "index 1"}},
+	}
+	for _, c := range cases {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		r := Runner{
+			Servers:         []string{ts.URL},
+			BatchSize:       10,
+			NumWorkers:      1,
+			RefreshInterval: "1s",
+			IndexName:       "abc",
+			OpType:          "index",
+			File:            f,
+			StateFile:       filepath.Join(t.TempDir(), "state.json"),
+			IdentifierField: "id",
+			Dedup:           c.dedup,
+			Ordered:         true,
+			RenameFields:    []string{"other:id"},
+			SetFields:       []string{"at={{now}}", "line={{line}}"},
+		}
+		if err := r.Run(); err != nil {
+			t.Fatalf("%s: %v", c.dedup, err)
+		}
+		if got := cluster.reset(); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.dedup, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/segmentio/encoding/json"
+)
+
+// ID hash functions.
+const (
+	IDHashSHA1   = "sha1"
+	IDHashXXHash = "xxhash"
+)
+
+// ErrInvalidIDHash is returned for an unknown id hash function.
+var ErrInvalidIDHash = errors.New("id hash must be sha1 or xxhash")
+
+// newIDHash returns a new hash for generating document IDs.
+func newIDHash(name string) (hash.Hash, error) {
+	switch name {
+	case IDHashSHA1:
+		return sha1.New(), nil
+	case IDHashXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, ErrInvalidIDHash
+	}
+}
+
+// hashDocumentID generates a deterministic ID from the content of a document.
+// Without fields, the whole document is hashed, as given. Otherwise, the JSON
+// values of the comma or space separated fields, with dots for nested fields,
+// are hashed.
+func hashDocumentID(doc, fields, name string) (string, error) {
+	h, err := newIDHash(name)
+	if err != nil {
+		return "", err
+	}
+	if fields == "" {
+		if !json.Valid([]byte(doc)) {
+			return "", errors.New("failed to json decode doc")
+		}
+		h.Write([]byte(doc))
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	var docmap map[string]any
+	dec := json.NewDecoder(strings.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&docmap); err != nil {
+		return "", fmt.Errorf("failed to json decode doc: %v", err)
+	}
+	for _, field := range strings.FieldsFunc(fields, func(r rune) bool { return r == ',' || r == ' ' }) {
+		var (
+			v  any
+			ok bool
+		)
+		if path := strings.Split(field, "."); len(path) > 1 {
+			v = nestedStr(path, docmap)
+			ok = v != nil
+		} else {
+			v, ok = docmap[field]
+		}
+		if !ok {
+			return "", fmt.Errorf("document has no ID field (%s)", field)
+		}
+		// Encoded values keep the types apart, e.g. 1 and "1", and the zero
+		// byte separates fields.
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		h.Write(b)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import "testing"
+
+func TestHashDocumentID(t *testing.T) {
+	var cases = []struct {
+		doc    string
+		fields string
+		hash   string
+		want   string
+		err    bool
+	}{
+		{`{"a": 1}`, "", IDHashSHA1, "e4ad4daad53a2eec0313386ada88211e50d693bd", false},
+		{`{"a": 1}`, "", IDHashXXHash, "e1e67aad799d917d", false},
+		{`{"a": 1, "b": {"c": "x"}}`, "a,b.c", IDHashXXHash, "", false},
+		{`{"a": 1}`, "b", IDHashXXHash, "", true},
+		{`{"a": 1`, "", IDHashXXHash, "", true},
+		{`{"a": 1}`, "", "md5", "", true},
+	}
+	for _, c := range cases {
+		got, err := hashDocumentID(c.doc, c.fields, c.hash)
+		if (err != nil) != c.err {
+			t.Fatalf("%s %s: got %v, want error %v", c.doc, c.fields, err, c.err)
+		}
+		if c.want != "" && got != c.want {
+			t.Fatalf("%s %s: got %s, want %s", c.doc, c.fields, got, c.want)
+		}
+	}
+	// Selected fields: other fields do not matter, types and field
+	// boundaries do.
+	id := func(doc string) string {
+		s, err := hashDocumentID(doc, "a,b", IDHashSHA1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	if id(`{"a": "x", "b": "yz", "c": 1}`) != id(`{"c": 2, "b": "yz", "a": "x"}`) {
+		t.Fatal("expected same id for same fields")
+	}
+	if id(`{"a": "x", "b": "yz"}`) == id(`{"a": "xy", "b": "z"}`) {
+		t.Fatal("expected different ids for different field boundaries")
+	}
+	if id(`{"a": 1, "b": 2}`) == id(`{"a": "1", "b": "2"}`) {
+		t.Fatal("expected different ids for different types")
+	}
+}
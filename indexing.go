@@ -24,13 +24,13 @@ package esbulk
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
+	"os"
 	"slices"
 	"strings"
 	"sync"
@@ -44,42 +44,160 @@ var (
 	// Worker errors
 	ErrWorkerCopyFailed = errors.New("worker failed to copy document batch")
 	ErrWorkerBulkIndex  = errors.New("worker bulk index operation failed")
+	ErrWorkerTransform  = errors.New("worker failed to transform document")
 )
 
 // Options represents bulk indexing options.
 type Options struct {
-	Servers            []string
-	Index              string
-	OpType             string
-	DocType            string
-	BatchSize          int
-	Verbose            bool
-	IDField            string
-	Scheme             string // http or https; deprecated, use: Servers.
-	Username           string
-	Password           string
-	ApiKey             string
-	Pipeline           string
+	Servers   []string
+	Index     string
+	OpType    string
+	DocType   string
+	BatchSize int
+	Verbose   bool
+	IDField   string
+	IDHash    string // sha1 or xxhash, to hash IDField or the whole document
+	Scheme    string // http or https; deprecated, use: Servers.
+	Username  string
+	Password  string
+	ApiKey    string
+	Pipeline  string
+	// Auth, if set, authenticates every request, instead of Username,
+	// Password and ApiKey.
+	Auth               Authenticator
 	IncludeTypeName    bool // https://www.elastic.co/blog/moving-from-types-to-typeless-apis-in-elasticsearch-7-0
 	InsecureSkipVerify bool
+	CACert             string // PEM file with additional trusted root certificates
+	ClientCert         string // PEM file with a client certificate for mutual TLS
+	ClientKey          string // PEM file with the client key, if not in ClientCert
+	TLSServerName      string // override the server name used for verification
+	TLSMinVersion      string // minimum TLS version, e.g. 1.2
+	AWSRegion          string // sign requests with AWS SigV4 for this region
+	AWSService         string // AWS service name for signing, default "es"
+	Proxy              string // http, https or socks5 proxy URL
 	// Timeout for HTTP requests (default: 30s)
 	RequestTimeout time.Duration
+	// CompressRequests gzips bulk request bodies at CompressLevel, 1 to 9,
+	// zero meaning the default level.
+	CompressRequests bool
+	CompressLevel    int
 	// HTTPClient is the shared client used for all requests. If nil, a
 	// default client is created lazily on first use (see client). Sharing a
 	// single client lets connections be reused (keep-alive) across the many
 	// batch requests issued during a run.
 	HTTPClient *pester.Client
+	// Transform, if set, is applied to every document by the workers, before
+	// it is added to a batch. Failing documents are skipped with SkipBroken.
+	Transform  Transform
+	SkipBroken bool
+	// SourceFilter, if set, is applied to every document after its ID has
+	// been read, so it can remove the ID field from the source. It must
+	// return a single document.
+	SourceFilter Transform
+	// Pool, if set, selects servers based on their health, instead of
+	// picking one at random.
+	Pool *ServerPool
+	// SyncStore, if set, records a content hash for every indexed document,
+	// so that unchanged documents are not sent again (requires IDField).
+	SyncStore *SyncStore
+	// Stats, if set, collects counters and timings of requests.
+	Stats *Stats
+	// LogBody controls how request bodies and documents appear in logs and
+	// errors: "full" (default), "none", "hash" or a maximum number of bytes.
+	LogBody string
+	// Logger receives all log messages. If nil, messages go to the default
+	// logger, or to stderr with debug level, if Verbose is set.
+	Logger *slog.Logger
+	// Plan, if set, turns bulk requests into a dry run: requests are built,
+	// but only recorded in the plan.
+	Plan *Plan
 }
 
-// client returns the shared HTTP client, creating a default one if none was
-// configured. Reusing a single client across requests enables connection
+// client returns the shared HTTP client, creating one from the options if none
+// was configured. Reusing a single client across requests enables connection
 // keep-alive; a fresh client per request would force a new TCP/TLS handshake
-// every time and can exhaust local ports under load.
-func (o *Options) client() *pester.Client {
+// every time and can exhaust local ports under load. An invalid TLS, proxy or
+// signing configuration is an error, since a default client would silently
+// ignore it.
+func (o *Options) client() (*pester.Client, error) {
 	if o.HTTPClient != nil {
-		return o.HTTPClient
+		return o.HTTPClient, nil
 	}
-	return CreateHTTPClient(o.InsecureSkipVerify, o.RequestTimeout)
+	client, err := NewHTTPClient(o.clientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http client: %w", err)
+	}
+	return client, nil
+}
+
+// clientConfig returns the HTTP client configuration from the options.
+func (o *Options) clientConfig() ClientConfig {
+	return ClientConfig{
+		Timeout:            o.RequestTimeout,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		CACert:             o.CACert,
+		ClientCert:         o.ClientCert,
+		ClientKey:          o.ClientKey,
+		ServerName:         o.TLSServerName,
+		MinTLSVersion:      o.TLSMinVersion,
+		AWSRegion:          o.AWSRegion,
+		AWSService:         o.AWSService,
+		Proxy:              o.Proxy,
+	}
+}
+
+// verboseLogger is used for verbose output, if no logger is configured.
+var verboseLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+// defaultLogger returns the logger to use, if none has been configured.
+func defaultLogger(verbose bool) *slog.Logger {
+	if verbose {
+		return verboseLogger
+	}
+	return slog.Default()
+}
+
+// logger returns the configured logger or a default one.
+func (o *Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return defaultLogger(o.Verbose)
+}
+
+// do sends a request with the shared client and records it in the stats.
+func (o *Options) do(req *http.Request) (*http.Response, error) {
+	client, err := o.client()
+	if err != nil {
+		return nil, err
+	}
+	defer o.Stats.requestStarted()()
+	var (
+		done  = o.Pool.track(req)
+		start = time.Now()
+	)
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	o.Stats.recordRequest(req, resp, err, elapsed)
+	done(resp, err, elapsed)
+	return resp, err
+}
+
+// server returns the server for the next request, from the pool, if there is
+// one, otherwise at random.
+func (o *Options) server() string {
+	if o.Pool != nil {
+		return o.Pool.Next()
+	}
+	return o.RandomServer()
+}
+
+// numServers returns the number of servers requests can be sent to.
+func (o *Options) numServers() int {
+	if o.Pool != nil {
+		return len(o.Pool.Servers())
+	}
+	return len(o.Servers)
 }
 
 // RandomServer returns a random server from the Servers slice.
@@ -93,28 +211,11 @@ func (o *Options) RandomServer() string {
 
 // CreateHTTPClient creates a pester client with optional TLS configuration and timeout.
 func CreateHTTPClient(insecureSkipVerify bool, timeout time.Duration) *pester.Client {
-	client := pester.New()
-
-	// Set default timeout if not specified
-	if timeout == 0 {
-		timeout = 30 * time.Second
-	}
-
-	client.Timeout = timeout
-
-	if insecureSkipVerify {
-		transport := &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
-		customClient := &http.Client{
-			Transport: transport,
-			Timeout:   timeout,
-		}
-		client.EmbedHTTPClient(customClient)
-	}
-
+	// Without certificate files, creating a client cannot fail.
+	client, _ := NewHTTPClient(ClientConfig{
+		InsecureSkipVerify: insecureSkipVerify,
+		Timeout:            timeout,
+	})
 	return client
 }
 
@@ -126,13 +227,19 @@ func CreateHTTPRequestWithContext(ctx context.Context, method, url string, body
 		return nil, err
 	}
 
-	// Set basic authentication if credentials are provided
-	if options.Username != "" && options.Password != "" {
-		req.SetBasicAuth(options.Username, options.Password)
-	}
-	// Or set ApiKey if provided
-	if options.ApiKey != "" {
-		req.Header.Set("Authorization", "ApiKey "+options.ApiKey)
+	if options.Auth != nil {
+		if err := options.Auth.Authenticate(req); err != nil {
+			return nil, err
+		}
+	} else {
+		// Set basic authentication if credentials are provided
+		if options.Username != "" && options.Password != "" {
+			req.SetBasicAuth(options.Username, options.Password)
+		}
+		// Or set ApiKey if provided
+		if options.ApiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+options.ApiKey)
+		}
 	}
 
 	// Set content type header (for requests with body)
@@ -150,21 +257,56 @@ func CreateHTTPRequest(method, url string, body io.Reader, options Options) (*ht
 	return CreateHTTPRequestWithContext(context.Background(), method, url, body, options)
 }
 
-// Item represents a bulk action.
+// ItemError describes why a single bulk action failed.
+type ItemError struct {
+	Type      string `json:"type"`
+	Reason    string `json:"reason"`
+	IndexUUID string `json:"index_uuid"`
+	Shard     string `json:"shard"`
+	Index     string `json:"index"`
+}
+
+// ItemResult is the outcome of a single bulk action.
+type ItemResult struct {
+	Index  string    `json:"_index"`
+	Type   string    `json:"_type"`
+	ID     string    `json:"_id"`
+	Status int       `json:"status"`
+	Result string    `json:"result"`
+	Error  ItemError `json:"error"`
+}
+
+// Item represents a bulk action. Only one of the actions is set, depending on
+// the op type used in the request.
 type Item struct {
-	IndexAction struct {
-		Index  string `json:"_index"`
-		Type   string `json:"_type"`
-		ID     string `json:"_id"`
-		Status int    `json:"status"`
-		Error  struct {
-			Type      string `json:"type"`
-			Reason    string `json:"reason"`
-			IndexUUID string `json:"index_uuid"`
-			Shard     string `json:"shard"`
-			Index     string `json:"index"`
-		} `json:"error"`
-	} `json:"index"`
+	IndexAction  ItemResult `json:"index"`
+	CreateAction ItemResult `json:"create"`
+	UpdateAction ItemResult `json:"update"`
+	DeleteAction ItemResult `json:"delete"`
+}
+
+// Action returns the result of whichever action this item describes.
+func (it Item) Action() ItemResult {
+	switch {
+	case it.CreateAction.Status != 0:
+		return it.CreateAction
+	case it.UpdateAction.Status != 0:
+		return it.UpdateAction
+	case it.DeleteAction.Status != 0:
+		return it.DeleteAction
+	default:
+		return it.IndexAction
+	}
+}
+
+// Succeeded returns true, if the action was applied. A delete of a document
+// that does not exist is considered successful, too.
+func (it Item) Succeeded() bool {
+	r := it.Action()
+	if r.Status == http.StatusNotFound && it.DeleteAction.Status != 0 {
+		return true
+	}
+	return r.Status >= 200 && r.Status < 300
 }
 
 // BulkResponse is a response to a bulk request.
@@ -220,13 +362,13 @@ func extractDocumentID(doc string, idField string) (string, string, error) {
 		if len(tokstr) > 1 {
 			TokenVal = nestedStr(tokstr, docmap)
 			if TokenVal == nil {
-				return "", "", fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
+				return "", "", fmt.Errorf("document has no ID field (%s)", currentID)
 			}
 		} else {
 			var ok2 bool
 			TokenVal, ok2 = docmap[currentID]
 			if !ok2 {
-				return "", "", fmt.Errorf("document has no ID field (%s): %s", currentID, doc)
+				return "", "", fmt.Errorf("document has no ID field (%s)", currentID)
 			}
 		}
 
@@ -257,20 +399,62 @@ func extractDocumentID(doc string, idField string) (string, string, error) {
 	return idstr, updatedDoc, nil
 }
 
-// BulkIndex takes a set of documents as strings and indexes them into elasticsearch.
-func BulkIndex(ctx context.Context, docs []string, options Options) error {
-	if len(docs) == 0 {
-		return nil
+// transform applies the configured transform to a document.
+func (o *Options) transform(doc string) ([]string, error) {
+	if o.Transform == nil {
+		return []string{doc}, nil
 	}
+	return o.Transform.Transform(doc)
+}
 
-	server := options.RandomServer()
+// filterSource applies the source filter to a document.
+func (o *Options) filterSource(doc string) (string, error) {
+	docs, err := o.SourceFilter.Transform(doc)
+	if err == nil && len(docs) != 1 {
+		err = fmt.Errorf("%w: source filter returned %d documents", ErrInvalidDocument, len(docs))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, o.loggedBody(doc))
+	}
+	return docs[0], nil
+}
 
-	link := fmt.Sprintf("%s/_bulk", server)
+// hasID returns true, if documents get an ID from a field or a hash.
+func (o *Options) hasID() bool {
+	return o.IDField != "" || o.IDHash != ""
+}
 
-	if options.Pipeline != "" {
-		link = fmt.Sprintf("%s/_bulk?pipeline=%s", server, options.Pipeline)
+// documentID returns the ID for a document as configured in options. If the
+// document had to be rewritten to extract the ID, the updated document is
+// returned as well, otherwise it is empty.
+func documentID(doc string, options Options) (string, string, error) {
+	if options.IDHash != "" {
+		id, err := hashDocumentID(doc, options.IDField, options.IDHash)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %s", err, options.loggedBody(doc))
+		}
+		return id, "", nil
+	}
+	id, updated, err := extractDocumentID(doc, options.IDField)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", err, options.loggedBody(doc))
 	}
+	return id, updated, nil
+}
 
+// BulkIndex takes a set of documents as strings and indexes them into elasticsearch.
+func BulkIndex(ctx context.Context, docs []string, options Options) error {
+	_, err := BulkIndexResponse(ctx, docs, options)
+	return err
+}
+
+// BulkIndexResponse works like BulkIndex, but returns the decoded bulk
+// response as well. If only some of the items failed, both the response and
+// an error are returned, so callers can inspect the outcome of every item.
+func BulkIndexResponse(ctx context.Context, docs []string, options Options) (*BulkResponse, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
 	var lines []string
 	for _, doc := range docs {
 		if len(strings.TrimSpace(doc)) == 0 {
@@ -285,10 +469,14 @@ func BulkIndex(ctx context.Context, docs []string, options Options) error {
 
 		// If an "-id" is given, peek into the document to extract the ID and
 		// use it in the header.
-		if options.IDField != "" {
-			idStr, updatedDoc, err := extractDocumentID(doc, options.IDField)
+		if options.hasID() {
+			idStr, updatedDoc, err := documentID(doc, options)
 			if err != nil {
-				return err
+				if options.Plan != nil {
+					options.Plan.recordFailure(err)
+					continue
+				}
+				return nil, err
 			}
 			if updatedDoc != "" {
 				doc = updatedDoc
@@ -302,57 +490,163 @@ func BulkIndex(ctx context.Context, docs []string, options Options) error {
 			}
 		}
 
+		if options.SourceFilter != nil {
+			filtered, err := options.filterSource(doc)
+			if err != nil {
+				if options.Plan != nil {
+					options.Plan.recordFailure(err)
+					continue
+				}
+				return nil, err
+			}
+			doc = filtered
+		}
+
 		if options.OpType == "update" {
 			doc = fmt.Sprintf(`{"doc": %s, "doc_as_upsert" : true}`, doc)
 		}
 
 		lines = append(lines, header, doc)
 	}
+	if options.Plan != nil {
+		if len(lines) == 0 {
+			return &BulkResponse{}, nil
+		}
+		return &BulkResponse{}, options.Plan.recordBatch(len(lines)/2, bulkBody(lines))
+	}
+	return bulkRequest(ctx, lines, len(lines)/2, options)
+}
 
-	body := fmt.Sprintf("%s\n", strings.Join(lines, "\n"))
-	if options.Verbose {
-		log.Printf("message content-length will be %d", len(body))
+// BulkDelete removes the documents with the given IDs from the index.
+// Deleting a document that does not exist is not an error.
+func BulkDelete(ctx context.Context, ids []string, options Options) (*BulkResponse, error) {
+	if len(ids) == 0 {
+		return nil, nil
 	}
+	var lines []string
+	for _, id := range ids {
+		if options.DocType == "" {
+			lines = append(lines, fmt.Sprintf(`{"delete": {"_index": "%s", "_id": %q}}`, options.Index, id))
+		} else {
+			lines = append(lines, fmt.Sprintf(`{"delete": {"_index": "%s", "_type": "%s", "_id": %q}}`,
+				options.Index, options.DocType, id))
+		}
+	}
+	br, err := bulkRequest(ctx, lines, len(ids), options)
+	if errors.Is(err, errBulkItemsFailed) {
+		// Only missing documents? Then there is nothing left to delete.
+		for _, item := range br.Items {
+			if !item.Succeeded() {
+				return br, err
+			}
+		}
+		return br, nil
+	}
+	return br, err
+}
+
+// errBulkItemsFailed is returned, if the bulk request succeeded, but at least
+// one of the items in it did not.
+var errBulkItemsFailed = errors.New("error during bulk operation, check error details; maybe try fewer workers (-w) or increase thread_pool.bulk.queue_size in your nodes")
+
+// bulkBody joins action and source lines into a bulk request body.
+func bulkBody(lines []string) string {
+	return fmt.Sprintf("%s\n", strings.Join(lines, "\n"))
+}
+
+// bulkRequest sends the given action and source lines for a number of
+// documents to the bulk API of a random server and decodes the response.
+func bulkRequest(ctx context.Context, lines []string, numDocs int, options Options) (*BulkResponse, error) {
+	var (
+		body    = bulkBody(lines)
+		payload = []byte(body)
+	)
+	if options.CompressRequests {
+		compressed, err := compressBody(body, options.CompressLevel)
+		if err != nil {
+			return nil, err
+		}
+		payload = compressed
+	}
+	options.Stats.recordBatch(len(body), len(payload))
 
 	// There are multiple ways indexing can fail, e.g. connection errors or
 	// bad requests. Finally, if we have a HTTP 200, the bulk request could
 	// still have failed: for that we need to decode the elasticsearch
-	// response.
-	req, err := CreateHTTPRequestWithContext(ctx, "POST", link, strings.NewReader(body), options)
-	if err != nil {
-		return err
-	}
+	// response. After a connection error or a response from a server that is
+	// unavailable, like 503, the request is sent to another server, once for
+	// each server. The pool counts both as failures of the server.
+	var (
+		response *http.Response
+		logger   *slog.Logger
+	)
+	for attempt := 1; ; attempt++ {
+		server := options.server()
+		link := fmt.Sprintf("%s/_bulk", server)
+		if options.Pipeline != "" {
+			link = fmt.Sprintf("%s/_bulk?pipeline=%s", server, options.Pipeline)
+		}
+		logger = options.logger().With("index", options.Index, "server", server)
+		logger.Debug("sending bulk request", "docs", numDocs, "bytes", len(body))
 
-	response, err := options.client().Do(req)
-	if err != nil {
-		return err
+		req, err := CreateHTTPRequestWithContext(ctx, "POST", link, bytes.NewReader(payload), options)
+		if err != nil {
+			return nil, err
+		}
+		if options.CompressRequests {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		response, err = options.do(req)
+		if err == nil && !isUnavailable(response.StatusCode) {
+			break
+		}
+		if ctx.Err() != nil || attempt >= options.numServers() {
+			if err == nil {
+				break // reported with the response below
+			}
+			options.Stats.recordFailedBatch(numDocs, "request_failed")
+			return nil, err
+		}
+		if err == nil {
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+			err = fmt.Errorf("server unavailable: %s", response.Status)
+		}
+		logger.Warn("bulk request failed, trying another server", "err", err)
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode >= 400 {
+		options.Stats.recordFailedBatch(numDocs, fmt.Sprintf("http_%d", response.StatusCode))
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, response.Body); err != nil {
-			return err
+			return nil, err
 		}
-		return fmt.Errorf("indexing failed with %d %s: %s",
+		return nil, fmt.Errorf("indexing failed with %d %s: %s",
 			response.StatusCode, http.StatusText(response.StatusCode), buf.String())
 	}
 
 	var br BulkResponse
 	if err := json.NewDecoder(response.Body).Decode(&br); err != nil {
-		return err
+		options.Stats.recordFailedBatch(numDocs, "invalid_response")
+		return nil, err
 	}
+	options.Stats.recordItems(&br)
 	if br.HasErrors {
-		if options.Verbose {
-			log.Println("error details: ")
-			for _, v := range br.Items {
-				log.Printf("  %q\n", v.IndexAction.Error)
+		var failed int
+		for _, item := range br.Items {
+			if item.Succeeded() {
+				continue
 			}
+			failed++
+			result := item.Action()
+			logger.Debug("bulk item failed", "id", result.ID, "status", result.Status,
+				"error_type", result.Error.Type, "reason", result.Error.Reason)
 		}
-		log.Printf("request body: %s", body)
-		return fmt.Errorf("error during bulk operation, check error details; maybe try fewer workers (-w) or increase thread_pool.bulk.queue_size in your nodes")
+		logger.Error("bulk request had errors", "docs", numDocs, "failed", failed, "body", options.loggedBody(body))
+		return &br, errBulkItemsFailed
 	}
-	return nil
+	return &br, nil
 }
 
 // Worker will batch index documents that come in on the lines channel. A batch
@@ -361,8 +655,19 @@ func BulkIndex(ctx context.Context, docs []string, options Options) error {
 // always returns nil to satisfy the WaitGroup contract.
 func Worker(ctx context.Context, id string, options Options, lines chan string, wg *sync.WaitGroup, errChan chan<- error) error {
 	defer wg.Done()
-	var docs []string
-	counter := 0
+	var (
+		docs    []string
+		counter = 0
+		batch   = 0
+		logger  = options.logger().With("worker", id)
+	)
+	// Each batch gets its own logger, so messages can be attributed.
+	batchOptions := func() Options {
+		batch++
+		opts := options
+		opts.Logger = logger.With("batch", batch)
+		return opts
+	}
 
 	for {
 		select {
@@ -374,19 +679,32 @@ func Worker(ctx context.Context, id string, options Options, lines chan string,
 				// Channel closed
 				goto processRemaining
 			}
-			docs = append(docs, s)
-			counter++
-			if counter%options.BatchSize == 0 {
+			transformed, err := options.transform(s)
+			if err != nil {
+				switch {
+				case options.Plan != nil:
+					options.Plan.recordFailure(err)
+				case options.SkipBroken:
+					options.Stats.recordSkipped()
+					logger.Debug("skipping document", "err", err, "doc", options.loggedBody(s))
+				default:
+					errChan <- fmt.Errorf("worker %s: %w: %w: %s", id, ErrWorkerTransform, err, options.loggedBody(s))
+				}
+				continue
+			}
+			docs = append(docs, transformed...)
+			counter += len(transformed)
+			if len(docs) >= options.BatchSize {
 				msg := make([]string, len(docs))
 				if n := copy(msg, docs); n != len(docs) {
 					errChan <- fmt.Errorf("worker %s: %w: expected %d, but got %d", id, ErrWorkerCopyFailed, len(docs), n)
-				} else if err := BulkIndex(ctx, msg, options); err != nil {
+				} else if err := indexBatch(ctx, msg, batchOptions()); err != nil {
 					// Drop the failed batch and report the error. Retaining it
 					// would let docs grow unbounded while the cluster is
 					// unavailable, defeating streaming.
 					errChan <- fmt.Errorf("worker %s: %w: %w", id, ErrWorkerBulkIndex, err)
-				} else if options.Verbose {
-					log.Printf("[%s] @%d\n", id, counter)
+				} else {
+					logger.Debug("batch indexed", "batch", batch, "docs", counter)
 				}
 				docs = nil
 			}
@@ -405,21 +723,28 @@ processRemaining:
 		return nil
 	}
 
-	if err := BulkIndex(ctx, msg, options); err != nil {
+	if err := indexBatch(ctx, msg, batchOptions()); err != nil {
 		errChan <- fmt.Errorf("worker %s: %w: %w", id, ErrWorkerBulkIndex, err)
 		return nil
 	}
-	if options.Verbose {
-		log.Printf("[%s] @%d\n", id, counter)
-	}
+	logger.Debug("batch indexed", "batch", batch, "docs", counter)
 
 	return nil
 }
 
+// indexBatch indexes a batch of documents. With a sync store configured, only
+// new or changed documents are sent.
+func indexBatch(ctx context.Context, docs []string, options Options) error {
+	if options.SyncStore == nil {
+		return BulkIndex(ctx, docs, options)
+	}
+	return options.SyncStore.Index(ctx, docs, options)
+}
+
 // PutMapping applies a mapping from a reader.
 func PutMapping(options Options, body io.Reader) error {
 
-	server := options.RandomServer()
+	server := options.server()
 	var link string
 	if options.DocType == "" {
 		link = fmt.Sprintf("%s/%s/_mapping", server, options.Index)
@@ -432,14 +757,12 @@ func PutMapping(options Options, body io.Reader) error {
 		}
 	}
 
-	if options.Verbose {
-		log.Printf("applying mapping: %s", link)
-	}
+	options.logger().Debug("applying mapping", "index", options.Index, "server", server, "link", link)
 	req, err := CreateHTTPRequest("PUT", link, body, options)
 	if err != nil {
 		return err
 	}
-	resp, err := options.client().Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return err
 	}
@@ -451,23 +774,20 @@ func PutMapping(options Options, body io.Reader) error {
 		}
 		return fmt.Errorf("failed to apply mapping with %s: %s", resp.Status, buf.String())
 	}
-	if options.Verbose {
-		log.Printf("applied mapping: %s", resp.Status)
-	}
+	options.logger().Debug("applied mapping", "index", options.Index, "server", server, "status", resp.Status)
 	return nil
 }
 
 // CreateIndex creates a new index.
 func CreateIndex(options Options, body io.Reader) error {
-	server := options.RandomServer()
+	server := options.server()
 	link := fmt.Sprintf("%s/%s", server, options.Index)
 
 	req, err := CreateHTTPRequest("GET", link, nil, options)
 	if err != nil {
 		return err
 	}
-	client := options.client()
-	resp, err := client.Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return err
 	}
@@ -482,7 +802,7 @@ func CreateIndex(options Options, body io.Reader) error {
 	if err != nil {
 		return err
 	}
-	resp, err = client.Do(req)
+	resp, err = options.do(req)
 	if err != nil {
 		return err
 	}
@@ -502,7 +822,8 @@ func CreateIndex(options Options, body io.Reader) error {
 				return nil
 			}
 		}
-		log.Printf("elasticsearch response was: %s", buf.String())
+		options.logger().Warn("could not create index", "index", options.Index, "server", server,
+			"response", buf.String())
 	}
 	if resp.StatusCode >= 400 {
 		var buf bytes.Buffer
@@ -511,28 +832,24 @@ func CreateIndex(options Options, body io.Reader) error {
 		}
 		return errors.New(buf.String())
 	}
-	if options.Verbose {
-		log.Printf("created index: %s\n", resp.Status)
-	}
+	options.logger().Debug("created index", "index", options.Index, "server", server, "status", resp.Status)
 	return nil
 }
 
 // DeleteIndex removes an index.
 func DeleteIndex(options Options) error {
 	var (
-		server = options.RandomServer()
+		server = options.server()
 		link   = fmt.Sprintf("%s/%s", server, options.Index)
 	)
 	req, err := CreateHTTPRequest("DELETE", link, nil, options)
 	if err != nil {
 		return err
 	}
-	resp, err := options.client().Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return err
 	}
-	if options.Verbose {
-		log.Printf("purged index: %s", resp.Status)
-	}
+	options.logger().Debug("purged index", "index", options.Index, "server", server, "status", resp.Status)
 	return resp.Body.Close()
 }
@@ -0,0 +1,129 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+)
+
+func TestWorkerLogging(t *testing.T) {
+	// A bulk endpoint, that rejects documents with a "bad" field.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			items  []map[string]any
+			errors bool
+			br     = bufio.NewScanner(r.Body)
+		)
+		for br.Scan() {
+			if !br.Scan() {
+				break
+			}
+			status := 201
+			if strings.Contains(br.Text(), "bad") {
+				status, errors = 400, true
+			}
+			items = append(items, map[string]any{"index": map[string]any{"status": status,
+				"error": map[string]any{"type": "mapper_parsing_exception"}}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"errors": errors, "items": items})
+	}))
+	defer ts.Close()
+	var cases = []struct {
+		level slog.Level
+		docs  []string
+		want  []string // level and message of the records, in order
+	}{
+		{slog.LevelInfo, []string{`{"a": 1}`, `{"a": 2}`}, nil},
+		{slog.LevelDebug, []string{`{"a": 1}`, `{"a": 2}`}, []string{
+			"DEBUG sending bulk request",
+			"DEBUG batch indexed",
+		}},
+		{slog.LevelInfo, []string{`{"a": 1}`, `{"bad": 2}`}, []string{
+			"ERROR bulk request had errors",
+		}},
+		{slog.LevelDebug, []string{`{"a": 1}`, `{"bad": 2}`}, []string{
+			"DEBUG sending bulk request",
+			"DEBUG bulk item failed",
+			"ERROR bulk request had errors",
+		}},
+	}
+	for i, c := range cases {
+		var (
+			buf     bytes.Buffer
+			lines   = make(chan string, len(c.docs))
+			errChan = make(chan error, 1)
+			wg      sync.WaitGroup
+			options = Options{
+				Servers:   []string{ts.URL},
+				Index:     "test",
+				OpType:    "index",
+				BatchSize: 10,
+				Logger:    slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: c.level})),
+				LogBody:   "none",
+			}
+		)
+		for _, doc := range c.docs {
+			lines <- doc
+		}
+		close(lines)
+		wg.Add(1)
+		Worker(context.Background(), "worker-3", options, lines, &wg, errChan)
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, fmt.Sprintf("%s %s", record["level"], record["msg"]))
+			// Every message can be attributed to a worker and a batch.
+			if record["worker"] != "worker-3" {
+				t.Errorf("[%d] %s: got worker %v, want worker-3", i, record["msg"], record["worker"])
+			}
+			if record["batch"] != 1.0 {
+				t.Errorf("[%d] %s: got batch %v, want 1", i, record["msg"], record["batch"])
+			}
+			if record["msg"] != "batch indexed" && (record["index"] != "test" || record["server"] != ts.URL) {
+				t.Errorf("[%d] %s: got index %v and server %v", i, record["msg"], record["index"], record["server"])
+			}
+			if record["msg"] == "bulk request had errors" && record["body"] != "[80 bytes omitted]" {
+				t.Errorf("[%d] got body %v, want it omitted", i, record["body"])
+			}
+		}
+		if strings.Join(got, ", ") != strings.Join(c.want, ", ") {
+			t.Errorf("[%d] got %v, want %v", i, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+const (
+	// maxDistinctValues limits the number of distinct string values tracked
+	// per field for the cardinality estimate.
+	maxDistinctValues = 10000
+	// maxKeywordLength is the longest string value, that is still considered a
+	// keyword; also used as ignore_above for keyword subfields.
+	maxKeywordLength = 256
+)
+
+// dateLayouts are the date layouts recognized during mapping inference, along
+// with the corresponding elasticsearch date format.
+var dateLayouts = []struct {
+	layout string
+	format string
+}{
+	{time.RFC3339Nano, "strict_date_optional_time"},
+	{"2006-01-02T15:04:05", "strict_date_optional_time"},
+	{"2006-01-02", "strict_date_optional_time"},
+	{"2006-01-02 15:04:05", "yyyy-MM-dd HH:mm:ss"},
+	{"2006/01/02", "yyyy/MM/dd"},
+}
+
+// MappingInference is the result of inferring a mapping from sample documents.
+type MappingInference struct {
+	// Mapping is a typeless mapping, e.g. {"properties": {...}}, that can be
+	// passed to PutMapping.
+	Mapping map[string]any
+	// Conflicts lists fields, that were found with different types across
+	// documents. The most frequent type is used in the mapping.
+	Conflicts []string
+	// NumDocs is the number of documents sampled.
+	NumDocs int
+}
+
+// Config returns the mapping wrapped into an index config, as used for
+// creating an index.
+func (m *MappingInference) Config() map[string]any {
+	return map[string]any{"mappings": m.Mapping}
+}
+
+// fieldStats collects the observed types of a single field.
+type fieldStats struct {
+	kinds    map[string]int // string, long, double, boolean, object
+	arrays   int            // arrays of objects, counted as object
+	strings  int
+	spaces   int
+	maxLen   int
+	distinct map[string]struct{}
+	dates    map[string]int // elasticsearch date format -> count
+	children map[string]*fieldStats
+}
+
+func newFieldStats() *fieldStats {
+	return &fieldStats{
+		kinds:    make(map[string]int),
+		distinct: make(map[string]struct{}),
+		dates:    make(map[string]int),
+		children: make(map[string]*fieldStats),
+	}
+}
+
+// InferMapping samples up to n documents from a reader of newline delimited
+// JSON and infers a mapping. If n is zero or negative, all documents are used.
+// Arrays of objects in the comma or space separated nested fields, with dots
+// for nested fields, are mapped to nested.
+func InferMapping(r io.Reader, n int, nested string) (*MappingInference, error) {
+	var (
+		br   = bufio.NewReader(r)
+		docs []string
+	)
+	for n <= 0 || len(docs) < n {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			docs = append(docs, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return InferMappingDocs(docs, nested)
+}
+
+// InferMappingDocs infers a mapping from a set of documents. Strings are
+// mapped to keyword or text, depending on their length and cardinality, or to
+// date, if all values parse as a date; numbers to long or double; objects and
+// arrays of objects to object. Arrays of objects are mapped to nested only in
+// the given nested fields, as nested fields are costly to index and limited
+// per document.
+func InferMappingDocs(docs []string, nested string) (*MappingInference, error) {
+	root := newFieldStats()
+	for i, doc := range docs {
+		var v map[string]any
+		dec := json.NewDecoder(strings.NewReader(doc))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("sample document %d: %w", i+1, err)
+		}
+		root.observeObject(v)
+	}
+	var (
+		result = &MappingInference{NumDocs: len(docs)}
+		inf    = inference{conflicts: &result.Conflicts, nested: make(map[string]bool)}
+	)
+	for _, path := range strings.FieldsFunc(nested, func(r rune) bool { return r == ',' || r == ' ' }) {
+		inf.nested[path] = true
+	}
+	properties := root.properties("", inf)
+	result.Mapping = map[string]any{"properties": properties}
+	return result, nil
+}
+
+// observeObject records the fields of a JSON object.
+func (f *fieldStats) observeObject(doc map[string]any) {
+	for k, v := range doc {
+		child, ok := f.children[k]
+		if !ok {
+			child = newFieldStats()
+			f.children[k] = child
+		}
+		child.observe(v)
+	}
+}
+
+// observe records a single value.
+func (f *fieldStats) observe(v any) {
+	switch t := v.(type) {
+	case nil:
+		// A null value tells us nothing about the type.
+	case bool:
+		f.kinds["boolean"]++
+	case json.Number:
+		if strings.ContainsAny(t.String(), ".eE") {
+			f.kinds["double"]++
+		} else {
+			f.kinds["long"]++
+		}
+	case string:
+		f.kinds["string"]++
+		f.strings++
+		if len(t) > f.maxLen {
+			f.maxLen = len(t)
+		}
+		if strings.ContainsAny(t, " \t\n") {
+			f.spaces++
+		}
+		if len(f.distinct) < maxDistinctValues {
+			f.distinct[t] = struct{}{}
+		}
+		for _, d := range dateLayouts {
+			if _, err := time.Parse(d.layout, t); err == nil {
+				f.dates[d.format]++
+				break
+			}
+		}
+	case map[string]any:
+		f.kinds["object"]++
+		f.observeObject(t)
+	case []any:
+		for _, elem := range t {
+			if m, ok := elem.(map[string]any); ok {
+				f.kinds["object"]++
+				f.arrays++
+				f.observeObject(m)
+			} else {
+				f.observe(elem)
+			}
+		}
+	}
+}
+
+// inference holds the settings and results shared by all fields.
+type inference struct {
+	conflicts *[]string
+	nested    map[string]bool // fields to map to nested
+}
+
+// properties returns the mapping properties for all children of f.
+func (f *fieldStats) properties(prefix string, inf inference) map[string]any {
+	var (
+		properties = make(map[string]any)
+		names      []string
+	)
+	for name := range f.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if m := f.children[name].mapping(prefix+name, inf); m != nil {
+			properties[name] = m
+		}
+	}
+	return properties
+}
+
+// mapping returns the mapping for a single field, or nil, if the field only
+// contained null values or empty arrays.
+func (f *fieldStats) mapping(path string, inf inference) map[string]any {
+	kinds := make(map[string]int)
+	for k, v := range f.kinds {
+		kinds[k] = v
+	}
+	// Integers and floats mix fine.
+	if kinds["long"] > 0 && kinds["double"] > 0 {
+		kinds["double"] += kinds["long"]
+		delete(kinds, "long")
+	}
+	var names []string
+	for k := range kinds {
+		names = append(names, k)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if kinds[names[i]] == kinds[names[j]] {
+			return names[i] < names[j]
+		}
+		return kinds[names[i]] > kinds[names[j]]
+	})
+	if len(names) > 1 {
+		var found []string
+		for _, k := range names {
+			found = append(found, fmt.Sprintf("%s (%d)", k, kinds[k]))
+		}
+		*inf.conflicts = append(*inf.conflicts, fmt.Sprintf("%s: %s, using %s",
+			path, strings.Join(found, ", "), names[0]))
+	}
+	switch kind := names[0]; kind {
+	case "object":
+		if f.arrays > 0 && inf.nested[path] {
+			return map[string]any{"type": "nested", "properties": f.properties(path+".", inf)}
+		}
+		return map[string]any{"properties": f.properties(path+".", inf)}
+	case "string":
+		return f.stringMapping()
+	default:
+		return map[string]any{"type": kind}
+	}
+}
+
+// stringMapping decides between date, keyword and text for string values.
+func (f *fieldStats) stringMapping() map[string]any {
+	var numDates int
+	for _, v := range f.dates {
+		numDates += v
+	}
+	if numDates == f.strings {
+		var formats []string
+		for format := range f.dates {
+			formats = append(formats, format)
+		}
+		sort.Strings(formats)
+		if len(formats) == 1 && formats[0] == "strict_date_optional_time" {
+			return map[string]any{"type": "date"}
+		}
+		return map[string]any{"type": "date", "format": strings.Join(formats, "||")}
+	}
+	var (
+		cardinality = float64(len(f.distinct)) / float64(f.strings)
+		prose       = f.spaces*2 > f.strings
+	)
+	switch {
+	case f.maxLen > maxKeywordLength:
+		return map[string]any{"type": "text"}
+	case prose && cardinality > 0.5:
+		return map[string]any{
+			"type": "text",
+			"fields": map[string]any{
+				"keyword": map[string]any{"type": "keyword", "ignore_above": maxKeywordLength},
+			},
+		}
+	default:
+		return map[string]any{"type": "keyword"}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/encoding/json"
+)
+
+func TestInferMapping(t *testing.T) {
+	var docs = `
+{"id": 1, "title": "A longer title with spaces", "tag": "a", "price": 1, "tags": ["x", "y"], "created": "2020-01-02"}
+{"id": 2, "title": "Another title, also with spaces", "tag": "a", "price": 2.5, "authors": [{"name": "x"}], "created": "2020-01-02 10:00:00"}
+{"id": "3", "title": null, "tag": "b", "meta": {"ok": true}, "authors": {"name": "y", "age": 3}}
+`
+	inferred, err := InferMapping(strings.NewReader(docs), 0, "")
+	if err != nil {
+		t.Fatalf("infer failed: %v", err)
+	}
+	if inferred.NumDocs != 3 {
+		t.Errorf("got %d docs, want 3", inferred.NumDocs)
+	}
+	b, err := json.Marshal(inferred.Mapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want = `{"properties":{` +
+		`"authors":{"properties":{"age":{"type":"long"},"name":{"type":"keyword"}}},` +
+		`"created":{"format":"strict_date_optional_time||yyyy-MM-dd HH:mm:ss","type":"date"},` +
+		`"id":{"type":"long"},` +
+		`"meta":{"properties":{"ok":{"type":"boolean"}}},` +
+		`"price":{"type":"double"},` +
+		`"tag":{"type":"keyword"},` +
+		`"tags":{"type":"keyword"},` +
+		`"title":{"fields":{"keyword":{"ignore_above":256,"type":"keyword"}},"type":"text"}}}`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", string(b), want)
+	}
+	if len(inferred.Conflicts) != 1 || !strings.HasPrefix(inferred.Conflicts[0], "id: long (2), string (1)") {
+		t.Errorf("unexpected conflicts: %v", inferred.Conflicts)
+	}
+	// Arrays of objects are mapped to nested only on request, objects never.
+	if inferred, err = InferMapping(strings.NewReader(docs), 0, "authors,meta"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = json.Marshal(inferred.Mapping); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`"authors":{"properties":{"age":{"type":"long"},"name":{"type":"keyword"}},"type":"nested"}`,
+		`"meta":{"properties":{"ok":{"type":"boolean"}}}`,
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("got %s, want %s", string(b), s)
+		}
+	}
+}
+
+func TestRunInferMapping(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	f, err := os.CreateTemp(t.TempDir(), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fmt.Fprintln(f, `{"id": "1", "old": "a", "secret": "x"}`)
+	fmt.Fprintln(f, `{"id": "2", "old": "b", "secret": "y"}`)
+	f.Seek(0, io.SeekStart)
+	// The mapping describes the documents as sent: renamed, transformed and
+	// filtered.
+	r := &Runner{
+		Servers:         []string{ts.URL},
+		BatchSize:       10,
+		NumWorkers:      1,
+		RefreshInterval: "1s",
+		IndexName:       "abc",
+		OpType:          "index",
+		IdentifierField: "id",
+		RenameFields:    []string{"old:new"},
+		TransformScript: writeScript(t, `function transform(doc) { doc.src = "file"; return doc; }`),
+		Exclude:         "secret",
+		InferMapping:    10,
+		File:            f,
+		StateFile:       filepath.Join(t.TempDir(), "state.json"),
+	}
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var mapping string
+	for _, req := range cluster.requests {
+		if strings.HasPrefix(req, "PUT /abc/_mapping") {
+			mapping = req
+		}
+	}
+	for _, s := range []string{`"new"`, `"src"`, `"id"`} {
+		if !strings.Contains(mapping, s) {
+			t.Errorf("mapping %q lacks %s", mapping, s)
+		}
+	}
+	for _, s := range []string{`"old"`, `"secret"`} {
+		if strings.Contains(mapping, s) {
+			t.Errorf("mapping %q has %s", mapping, s)
+		}
+	}
+	if got := cluster.reset(); len(got) != 2 {
+		t.Fatalf("got %v, want 2 actions", got)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// latencyBuckets are the upper bounds of the bulk request latency histogram,
+// in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram is a cumulative histogram over latencyBuckets.
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(latencyBuckets))
+	}
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// labelEscaper escapes label values for the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// setQueueDepth registers a function reporting the number of documents
+// waiting for a worker.
+func (s *Stats) setQueueDepth(f func() int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueDepth = f
+}
+
+// WriteMetrics writes the current stats in the Prometheus text exposition
+// format.
+func (s *Stats) WriteMetrics(w io.Writer) error {
+	var err error
+	printf := func(format string, a ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+	metric := func(name, kind, help string, value int64) {
+		printf("# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("esbulk_docs_queued_total", "counter", "Documents read from the input and queued for indexing.", s.DocsRead.Load())
+	metric("esbulk_docs_indexed_total", "counter", "Documents indexed successfully.",
+		s.Created.Load()+s.Updated.Load()+s.Noop.Load()+s.Deleted.Load())
+	metric("esbulk_docs_failed_total", "counter", "Documents that failed to index.", s.Failed.Load())
+	metric("esbulk_docs_skipped_total", "counter", "Broken documents skipped.", s.SkippedBroken.Load())
+	metric("esbulk_docs_unchanged_total", "counter", "Documents not sent, since they did not change.", s.Unchanged.Load())
+	metric("esbulk_docs_duplicate_total", "counter", "Documents not sent, since their ID occurred before or later.", s.Duplicates.Load())
+	metric("esbulk_retries_total", "counter", "HTTP request retries.", s.Retries.Load())
+	metric("esbulk_batches_total", "counter", "Bulk requests sent.", s.Batches.Load())
+	metric("esbulk_bulk_body_bytes_total", "counter", "Bytes of bulk request bodies sent, uncompressed.", s.Bytes.Load())
+	metric("esbulk_bulk_sent_bytes_total", "counter", "Bytes of bulk request bodies sent, as on the wire.", s.BytesSent.Load())
+	metric("esbulk_input_read_bytes", "gauge", "Offset into the input file.", s.BytesRead.Load())
+	metric("esbulk_inflight_requests", "gauge", "HTTP requests currently in flight.", s.InFlight.Load())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var depth int
+	if s.queueDepth != nil {
+		depth = s.queueDepth()
+	}
+	metric("esbulk_queue_depth", "gauge", "Documents waiting for a worker.", int64(depth))
+	var servers []string
+	for server := range s.servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	printf("# HELP esbulk_requests_total HTTP requests per server.\n# TYPE esbulk_requests_total counter\n")
+	for _, server := range servers {
+		printf("esbulk_requests_total{server=\"%s\"} %d\n", labelEscaper.Replace(server), s.servers[server].requests)
+	}
+	printf("# HELP esbulk_request_errors_total Failed HTTP requests per server.\n# TYPE esbulk_request_errors_total counter\n")
+	for _, server := range servers {
+		printf("esbulk_request_errors_total{server=\"%s\"} %d\n", labelEscaper.Replace(server), s.servers[server].errors)
+	}
+	printf("# HELP esbulk_bulk_request_duration_seconds Bulk request latency per server.\n# TYPE esbulk_bulk_request_duration_seconds histogram\n")
+	for _, server := range servers {
+		var (
+			h     = s.servers[server].bulk
+			label = labelEscaper.Replace(server)
+		)
+		if h.count == 0 {
+			continue
+		}
+		for i, le := range latencyBuckets {
+			printf("esbulk_bulk_request_duration_seconds_bucket{server=\"%s\",le=\"%g\"} %d\n", label, le, h.counts[i])
+		}
+		printf("esbulk_bulk_request_duration_seconds_bucket{server=\"%s\",le=\"+Inf\"} %d\n", label, h.count)
+		printf("esbulk_bulk_request_duration_seconds_sum{server=\"%s\"} %g\n", label, h.sum)
+		printf("esbulk_bulk_request_duration_seconds_count{server=\"%s\"} %d\n", label, h.count)
+	}
+	return err
+}
+
+// ServeMetrics serves the stats on /metrics at the given address, until the
+// returned server is closed.
+func ServeMetrics(addr string, stats *Stats) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: metricsHandler(stats)}
+	go srv.Serve(ln)
+	return srv, nil
+}
+
+// metricsHandler serves the stats on /metrics.
+func metricsHandler(stats *Stats) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WriteMetrics(w)
+	})
+	return mux
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	stats := NewStats()
+	stats.DocsRead.Add(10)
+	stats.Created.Add(7)
+	stats.Updated.Add(1)
+	stats.recordBatch(1000, 250)
+	stats.setQueueDepth(func() int { return 3 })
+	req, _ := http.NewRequest("POST", `http://es:9200/abc/_bulk`, nil)
+	stats.recordRequest(req, &http.Response{StatusCode: 200}, nil, 20*time.Millisecond)
+	stats.recordRequest(req, &http.Response{StatusCode: 503}, nil, 2*time.Second)
+
+	ts := httptest.NewServer(metricsHandler(stats))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("got content type %s", ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		sample  = regexp.MustCompile(`^([a-z_]+)(\{[^}]*\})? ([0-9.e+-]+)$`)
+		types   = make(map[string]string)
+		values  = make(map[string]string)
+		scanner = bufio.NewScanner(strings.NewReader(string(b)))
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			types[fields[2]] = fields[3]
+			continue
+		}
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		if m == nil {
+			t.Fatalf("invalid line: %s", line)
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(m[1], "_bucket"), "_sum"), "_count")
+		if _, ok := types[name]; !ok {
+			t.Fatalf("no type for %s", m[1])
+		}
+		values[m[1]+m[2]] = m[3]
+	}
+	for name, kind := range types {
+		if !strings.HasPrefix(name, "esbulk_") {
+			t.Errorf("%s: missing namespace", name)
+		}
+		if (kind == "counter") != strings.HasSuffix(name, "_total") {
+			t.Errorf("%s: a %s must end with _total, if and only if it is a counter", name, kind)
+		}
+		if strings.Contains(name, "bytes") && !strings.HasSuffix(strings.TrimSuffix(name, "_total"), "_bytes") {
+			t.Errorf("%s: unit must be a suffix", name)
+		}
+	}
+	for series, want := range map[string]string{
+		"esbulk_docs_queued_total":                             "10",
+		"esbulk_docs_indexed_total":                            "8",
+		"esbulk_batches_total":                                 "1",
+		"esbulk_bulk_body_bytes_total":                         "1000",
+		"esbulk_bulk_sent_bytes_total":                         "250",
+		"esbulk_queue_depth":                                   "3",
+		`esbulk_requests_total{server="http://es:9200"}`:       "2",
+		`esbulk_request_errors_total{server="http://es:9200"}`: "1",
+		`esbulk_bulk_request_duration_seconds_bucket{server="http://es:9200",le="0.025"}`: "1",
+		`esbulk_bulk_request_duration_seconds_bucket{server="http://es:9200",le="+Inf"}`:  "2",
+		`esbulk_bulk_request_duration_seconds_count{server="http://es:9200"}`:             "2",
+		`esbulk_bulk_request_duration_seconds_sum{server="http://es:9200"}`:               "2.02",
+	} {
+		if got := values[series]; got != want {
+			t.Errorf("%s: got %q, want %q", series, got, want)
+		}
+	}
+}
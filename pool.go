@@ -0,0 +1,334 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Server selection strategies.
+const (
+	RoundRobin    = "round-robin"
+	LeastInFlight = "least-in-flight"
+)
+
+// serverProbeInterval is the interval at which servers that are down are
+// checked.
+const serverProbeInterval = 5 * time.Second
+
+// ErrInvalidStrategy is returned for an unknown server selection strategy.
+var ErrInvalidStrategy = errors.New("server selection must be round-robin or least-in-flight")
+
+// serverState is the circuit breaker state of a server.
+type serverState int
+
+const (
+	serverUp      serverState = iota // closed, requests are sent
+	serverDown                       // open, no requests are sent
+	serverProbing                    // half-open, a single trial request is sent
+)
+
+func (s serverState) String() string {
+	switch s {
+	case serverDown:
+		return "down"
+	case serverProbing:
+		return "probing"
+	default:
+		return "up"
+	}
+}
+
+// serverNode is a server and its health.
+type serverNode struct {
+	url      string
+	key      string // scheme and host, as in request URLs
+	state    serverState
+	changed  time.Time // of the last state change or failed trial
+	failures int       // consecutive failures
+	inFlight int
+	latency  time.Duration // moving average
+}
+
+// ServerPool selects servers for requests, based on their health. A server
+// that fails a number of requests in a row is taken out of rotation. After a
+// timeout, a single trial request is sent to it, by a probe or a regular
+// request; if that succeeds, the server is used again. The pool is safe for
+// concurrent use.
+type ServerPool struct {
+	// Strategy is RoundRobin or LeastInFlight.
+	Strategy string
+	// FailureThreshold is the number of consecutive failures, after which
+	// a server is considered down.
+	FailureThreshold int
+	// DownTimeout is the time before a trial request is sent to a server
+	// that is down.
+	DownTimeout time.Duration
+	Logger      *slog.Logger
+
+	mu    sync.Mutex
+	nodes []*serverNode
+	next  int
+}
+
+// NewServerPool creates a pool of servers, which must include the scheme.
+func NewServerPool(servers []string, strategy string) (*ServerPool, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastInFlight:
+	default:
+		return nil, ErrInvalidStrategy
+	}
+	p := &ServerPool{
+		Strategy:         strategy,
+		FailureThreshold: 3,
+		DownTimeout:      10 * time.Second,
+	}
+	for _, s := range servers {
+		p.nodes = append(p.nodes, &serverNode{url: s, key: serverKey(s)})
+	}
+	return p, nil
+}
+
+// serverKey returns scheme and host of a server URL.
+func serverKey(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+func (p *ServerPool) logger() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
+	}
+	return p.Logger
+}
+
+// Next returns the server to send the next request to. Servers that are down
+// are skipped, unless a trial request is due. If all servers are down, the
+// one that has been down the longest is returned.
+func (p *ServerPool) Next() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.nodes) == 0 {
+		return ""
+	}
+	var (
+		now        = time.Now()
+		candidates []*serverNode
+	)
+	for _, n := range p.nodes {
+		switch {
+		case n.state == serverUp:
+			candidates = append(candidates, n)
+		case now.Sub(n.changed) >= p.DownTimeout:
+			// A trial is due, or a previous trial never completed.
+			p.setState(n, serverProbing)
+			return n.url
+		}
+	}
+	if len(candidates) == 0 {
+		oldest := p.nodes[0]
+		for _, n := range p.nodes[1:] {
+			if n.changed.Before(oldest.changed) {
+				oldest = n
+			}
+		}
+		return oldest.url
+	}
+	if p.Strategy == LeastInFlight {
+		best := candidates[0]
+		for _, n := range candidates[1:] {
+			if n.inFlight < best.inFlight || (n.inFlight == best.inFlight && n.latency < best.latency) {
+				best = n
+			}
+		}
+		return best.url
+	}
+	p.next++
+	return candidates[p.next%len(candidates)].url
+}
+
+// Servers returns all servers in the pool, regardless of their state.
+func (p *ServerPool) Servers() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	servers := make([]string, len(p.nodes))
+	for i, n := range p.nodes {
+		servers[i] = n.url
+	}
+	return servers
+}
+
+// State returns the state of a server: "up", "down" or "probing", or an empty
+// string, if the server is not in the pool.
+func (p *ServerPool) State(server string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := p.node(serverKey(server)); n != nil {
+		return n.state.String()
+	}
+	return ""
+}
+
+// node returns the node for a key, or nil. Must be called with the lock held.
+func (p *ServerPool) node(key string) *serverNode {
+	for _, n := range p.nodes {
+		if n.key == key {
+			return n
+		}
+	}
+	return nil
+}
+
+// setState changes the state of a node. Must be called with the lock held.
+func (p *ServerPool) setState(n *serverNode, state serverState) {
+	n.changed = time.Now()
+	if n.state == state {
+		return
+	}
+	switch state {
+	case serverDown:
+		p.logger().Warn("server is down", "server", n.url, "failures", n.failures)
+	case serverUp:
+		p.logger().Info("server is up again", "server", n.url)
+	}
+	n.state = state
+}
+
+// track records a request as in flight and returns a function to call with
+// the outcome of the request, which updates the health of the server.
+func (p *ServerPool) track(req *http.Request) func(resp *http.Response, err error, elapsed time.Duration) {
+	if p == nil {
+		return func(*http.Response, error, time.Duration) {}
+	}
+	key := req.URL.Scheme + "://" + req.URL.Host
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := p.node(key)
+	if n == nil {
+		return func(*http.Response, error, time.Duration) {}
+	}
+	n.inFlight++
+	return func(resp *http.Response, err error, elapsed time.Duration) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		n.inFlight--
+		if err != nil && req.Context().Err() != nil {
+			return // cancelled, says nothing about the server
+		}
+		if err != nil || isUnavailable(resp.StatusCode) {
+			n.failures++
+			if n.state != serverUp || n.failures >= p.FailureThreshold {
+				p.setState(n, serverDown)
+			}
+			return
+		}
+		n.failures = 0
+		if n.latency == 0 {
+			n.latency = elapsed
+		} else {
+			n.latency = (4*n.latency + elapsed) / 5
+		}
+		p.setState(n, serverUp)
+	}
+}
+
+// isUnavailable returns true for status codes, that indicate a server which
+// cannot handle requests right now.
+func isUnavailable(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// Probe sends a trial request to servers that are down, once their timeout
+// has passed, by calling check at every interval until the context is done.
+// The check is expected to send a request through Options, so its outcome
+// updates the health of the server.
+func (p *ServerPool) Probe(ctx context.Context, interval time.Duration, check func(ctx context.Context, server string) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var due []string
+		p.mu.Lock()
+		for _, n := range p.nodes {
+			if n.state != serverUp && time.Since(n.changed) >= p.DownTimeout {
+				p.setState(n, serverProbing)
+				due = append(due, n.url)
+			}
+		}
+		p.mu.Unlock()
+		for _, server := range due {
+			if err := check(ctx, server); err != nil {
+				p.logger().Debug("probe failed", "server", server, "err", err)
+			}
+		}
+	}
+}
+
+// pingServer sends a request to the root of a server.
+func pingServer(ctx context.Context, server string, options Options) error {
+	req, err := CreateHTTPRequestWithContext(ctx, "GET", server, nil, options)
+	if err != nil {
+		return err
+	}
+	resp, err := options.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// Update replaces the servers of the pool, keeping the health of servers that
+// were already in it.
+func (p *ServerPool) Update(servers []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	nodes := make([]*serverNode, 0, len(servers))
+	for _, s := range servers {
+		key := serverKey(s)
+		if n := p.node(key); n != nil {
+			nodes = append(nodes, n)
+			continue
+		}
+		nodes = append(nodes, &serverNode{url: s, key: key})
+	}
+	p.nodes = nodes
+}
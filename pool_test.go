@@ -0,0 +1,162 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sethgrid/pester"
+)
+
+func TestServerPoolFailover(t *testing.T) {
+	var (
+		fake  = &fakeBulkServer{}
+		up1   = httptest.NewServer(fake)
+		up2   = httptest.NewServer(fake)
+		down  = httptest.NewServer(fake)
+		ctx   = context.Background()
+		docs  []string
+		stats = NewStats()
+	)
+	defer up1.Close()
+	defer up2.Close()
+	down.Close()
+	pool, err := NewServerPool([]string{up1.URL, down.URL, up2.URL}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.DownTimeout = time.Hour
+	client := pester.New()
+	client.MaxRetries = 1
+	options := Options{
+		Servers:    []string{up1.URL, down.URL, up2.URL},
+		Index:      "test",
+		OpType:     "index",
+		BatchSize:  5,
+		IDField:    "id",
+		Pool:       pool,
+		HTTPClient: client,
+		Stats:      stats,
+	}
+	for i := 0; i < 5; i++ {
+		docs = append(docs, fmt.Sprintf(`{"id": "%d"}`, i))
+	}
+	for i := 0; i < 20; i++ {
+		if err := BulkIndex(ctx, docs, options); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+	}
+	if got := len(fake.reset()); got != 100 {
+		t.Fatalf("got %d items, want 100", got)
+	}
+	if got := pool.State(down.URL); got != "down" {
+		t.Fatalf("got state %q, want down", got)
+	}
+	if got := stats.Report().Servers[down.URL].Requests; got != int64(pool.FailureThreshold) {
+		t.Fatalf("got %d requests to server that is down, want %d", got, pool.FailureThreshold)
+	}
+}
+
+func TestServerPoolUnavailable(t *testing.T) {
+	var (
+		fake        = &fakeBulkServer{}
+		up          = httptest.NewServer(fake)
+		unavailable = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}))
+		stats = NewStats()
+	)
+	defer up.Close()
+	defer unavailable.Close()
+	pool, err := NewServerPool([]string{unavailable.URL, up.URL}, RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.DownTimeout = time.Hour
+	client := pester.New()
+	client.MaxRetries = 1
+	options := Options{
+		Servers:    []string{unavailable.URL, up.URL},
+		Index:      "test",
+		OpType:     "index",
+		BatchSize:  5,
+		IDField:    "id",
+		Pool:       pool,
+		HTTPClient: client,
+		Stats:      stats,
+	}
+	// A 503 is not a failed batch, the batch goes to the other server.
+	for i := 0; i < 10; i++ {
+		if err := BulkIndex(context.Background(), []string{fmt.Sprintf(`{"id": "%d"}`, i)}, options); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+	}
+	if got := len(fake.reset()); got != 10 {
+		t.Fatalf("got %d items, want 10", got)
+	}
+	if got := pool.State(unavailable.URL); got != "down" {
+		t.Fatalf("got state %q, want down", got)
+	}
+	if got := stats.Report().Servers[unavailable.URL].Requests; got != int64(pool.FailureThreshold) {
+		t.Fatalf("got %d requests to unavailable server, want %d", got, pool.FailureThreshold)
+	}
+	// Without another server, the batch fails with the response.
+	options.Servers, options.Pool = []string{unavailable.URL}, nil
+	if err := BulkIndex(context.Background(), []string{`{"id": "x"}`}, options); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got %v, want 503 error", err)
+	}
+}
+
+func TestServerPoolRecovery(t *testing.T) {
+	pool, err := NewServerPool([]string{"http://a:9200", "http://b:9200"}, LeastInFlight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.FailureThreshold = 1
+	pool.DownTimeout = 0
+	fail := pool.track(httptest.NewRequest("GET", "http://a:9200/", nil))
+	fail(nil, context.DeadlineExceeded, time.Second)
+	if got := pool.State("http://a:9200"); got != "down" {
+		t.Fatalf("got state %q, want down", got)
+	}
+	// With a zero timeout, the next request is a trial.
+	if got := pool.Next(); got != "http://a:9200" {
+		t.Fatalf("got %s, want trial request to http://a:9200", got)
+	}
+	if got := pool.State("http://a:9200"); got != "probing" {
+		t.Fatalf("got state %q, want probing", got)
+	}
+	ok := pool.track(httptest.NewRequest("GET", "http://a:9200/", nil))
+	ok(httptest.NewRecorder().Result(), nil, time.Millisecond)
+	if got := pool.State("http://a:9200"); got != "up" {
+		t.Fatalf("got state %q, want up", got)
+	}
+	if _, err := NewServerPool(nil, "random"); err != ErrInvalidStrategy {
+		t.Fatalf("got %v, want %v", err, ErrInvalidStrategy)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// progressTTYInterval is the refresh interval of the progress line on a
+	// terminal.
+	progressTTYInterval = 500 * time.Millisecond
+	// progressLogInterval is the interval of progress log lines, if stderr is
+	// not a terminal.
+	progressLogInterval = 10 * time.Second
+)
+
+// progress reports how far along a run is, based on the number of bytes read
+// from the input, if its size is known.
+type progress struct {
+	stats *Stats
+	total int64 // input size in bytes, zero if unknown
+	start time.Time
+}
+
+// isTerminal returns true, if f is a character device, e.g. a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress starts reporting progress to stderr, refreshed in place on a
+// terminal and as periodic log lines otherwise. The returned function stops
+// the reporting and prints a final status.
+func (r *Runner) startProgress() func() {
+	p := &progress{stats: r.stats, total: inputSize(r.File), start: time.Now()}
+	var (
+		tty      = isTerminal(os.Stderr)
+		logger   = r.log()
+		interval = progressLogInterval
+		done     = make(chan struct{})
+		wg       sync.WaitGroup
+	)
+	if tty {
+		interval = progressTTYInterval
+	}
+	wg.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if tty {
+					fmt.Fprintf(os.Stderr, "\r\033[K%s", p.status())
+				} else {
+					p.log(logger)
+				}
+			}
+		}
+	})
+	return func() {
+		close(done)
+		wg.Wait()
+		if tty {
+			fmt.Fprintf(os.Stderr, "\r\033[K%s\n", p.status())
+		} else {
+			p.log(logger)
+		}
+	}
+}
+
+// inputSize returns the size of a regular file, or zero, if it is unknown.
+// For compressed input, this is the compressed size, which is fine, since we
+// count bytes before decompression as well.
+func inputSize(f *os.File) int64 {
+	if f == nil {
+		return 0
+	}
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		return fi.Size()
+	}
+	return 0
+}
+
+// log writes the current progress as a log message.
+func (p *progress) log(logger *slog.Logger) {
+	logger.Info("progress", "docs", p.stats.DocsRead.Load(), "bytes_read", p.stats.BytesRead.Load(),
+		"bytes_total", p.total, "errors", p.stats.Failed.Load(), "retries", p.stats.Retries.Load(),
+		"status", p.status())
+}
+
+// status returns a single line describing the current progress.
+func (p *progress) status() string {
+	return p.statusAt(time.Now())
+}
+
+// statusAt returns the progress line at a given time.
+func (p *progress) statusAt(now time.Time) string {
+	var (
+		elapsed = now.Sub(p.start).Seconds()
+		offset  = p.stats.BytesRead.Load()
+		docs    = p.stats.DocsRead.Load()
+		errors  = p.stats.Failed.Load()
+		retries = p.stats.Retries.Load()
+	)
+	if elapsed < 0.1 {
+		elapsed = 0.1
+	}
+	var w strings.Builder
+	if p.total > 0 {
+		fmt.Fprintf(&w, "%5.1f%% ", 100*float64(offset)/float64(p.total))
+	}
+	fmt.Fprintf(&w, "%d docs, %0.0f docs/s, %0.2f MB/s", docs, float64(docs)/elapsed,
+		float64(offset)/elapsed/1e6)
+	if p.total > 0 && offset > 0 && offset < p.total {
+		eta := time.Duration(elapsed * float64(p.total-offset) / float64(offset) * float64(time.Second))
+		fmt.Fprintf(&w, ", ETA %s", eta.Round(time.Second))
+	}
+	fmt.Fprintf(&w, ", %d errors, %d retries", errors, retries)
+	return w.String()
+}
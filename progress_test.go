@@ -0,0 +1,122 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressStatus(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var cases = []struct {
+		total, offset, docs int64
+		elapsed             time.Duration
+		want                string
+	}{
+		{0, 2e6, 1000, 10 * time.Second, "1000 docs, 100 docs/s, 0.20 MB/s, 0 errors, 0 retries"},
+		{4e6, 1e6, 1000, 10 * time.Second, " 25.0% 1000 docs, 100 docs/s, 0.10 MB/s, ETA 30s, 0 errors, 0 retries"},
+		{4e6, 0, 0, 10 * time.Second, "  0.0% 0 docs, 0 docs/s, 0.00 MB/s, 0 errors, 0 retries"},
+		{4e6, 4e6, 10, 4 * time.Second, "100.0% 10 docs, 2 docs/s, 1.00 MB/s, 0 errors, 0 retries"},
+		{3e6, 1e6, 1, 90 * time.Second, " 33.3% 1 docs, 0 docs/s, 0.01 MB/s, ETA 3m0s, 0 errors, 0 retries"},
+		// Right at the start, rates are not inflated.
+		{0, 1e5, 10, 0, "10 docs, 100 docs/s, 1.00 MB/s, 0 errors, 0 retries"},
+	}
+	for _, c := range cases {
+		p := &progress{stats: NewStats(), total: c.total, start: start}
+		p.stats.BytesRead.Store(c.offset)
+		p.stats.DocsRead.Store(c.docs)
+		if got := p.statusAt(start.Add(c.elapsed)); got != c.want {
+			t.Errorf("got %q, want %q", got, c.want)
+		}
+	}
+	p := &progress{stats: NewStats(), start: start}
+	p.stats.Failed.Store(3)
+	p.stats.Retries.Store(2)
+	if got := p.statusAt(start.Add(time.Second)); !strings.HasSuffix(got, ", 3 errors, 2 retries") {
+		t.Errorf("got %q, want errors and retries", got)
+	}
+}
+
+func TestProgressInputSize(t *testing.T) {
+	var (
+		dir      = t.TempDir()
+		filename = filepath.Join(dir, "docs.ldj.gz")
+	)
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(zw, `{"id": %d, "text": "the same text over and over"}`+"\n", i)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inputSize(f); got != fi.Size() {
+		t.Fatalf("got %d, want %d", got, fi.Size())
+	}
+	// Progress is based on the compressed bytes read, so a completely read
+	// compressed file is at 100%.
+	r := &Runner{File: f, FileGzipped: true, stats: NewStats()}
+	reader, err := r.input()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n <= fi.Size() {
+		t.Fatalf("got %d bytes decompressed from %d, want more", n, fi.Size())
+	}
+	p := &progress{stats: r.stats, total: inputSize(f), start: time.Now()}
+	if got := p.status(); !strings.HasPrefix(got, "100.0% ") || strings.Contains(got, "ETA") {
+		t.Fatalf("got %q, want 100%% without ETA", got)
+	}
+	// The size of a pipe or no file is unknown.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+	for _, f := range []*os.File{pr, nil} {
+		if got := inputSize(f); got != 0 {
+			t.Fatalf("got %d, want 0 for unknown size", got)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidLogBody is returned for an unknown request body log policy.
+var ErrInvalidLogBody = errors.New("log body policy must be full, none, hash or a byte limit")
+
+// redacted replaces secrets in log output.
+const redacted = "[REDACTED]"
+
+// mask returns a placeholder for non-empty secrets.
+func mask(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// maskURL masks the user info of a URL, like the password of a proxy.
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return mask(s)
+	}
+	if u.User == nil {
+		return s
+	}
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://"+redacted+"@", 1)
+}
+
+// maskedAuth stands in for an authenticator, which may hold passwords, tokens
+// or header values, in string representations.
+type maskedAuth string
+
+// Authenticate does nothing.
+func (maskedAuth) Authenticate(*http.Request) error { return nil }
+
+// String returns the type of the authenticator, without its secrets.
+func (a maskedAuth) String() string { return string(a) }
+
+// maskAuth returns a placeholder for an authenticator.
+func maskAuth(a Authenticator) Authenticator {
+	if a == nil {
+		return nil
+	}
+	return maskedAuth(fmt.Sprintf("%T%s", a, redacted))
+}
+
+// String returns a representation of the options with secrets masked.
+func (o Options) String() string {
+	type plain Options // without methods, to avoid recursion
+	o.Password = mask(o.Password)
+	o.ApiKey = mask(o.ApiKey)
+	o.Auth = maskAuth(o.Auth)
+	o.Proxy = maskURL(o.Proxy)
+	return fmt.Sprintf("%+v", plain(o))
+}
+
+// LogValue implements slog.LogValuer and masks secrets.
+func (o Options) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Any("servers", o.Servers),
+		slog.String("index", o.Index),
+		slog.String("op_type", o.OpType),
+		slog.String("doc_type", o.DocType),
+		slog.Int("batch_size", o.BatchSize),
+		slog.String("id_field", o.IDField),
+		slog.String("id_hash", o.IDHash),
+		slog.String("username", o.Username),
+		slog.String("password", mask(o.Password)),
+		slog.String("api_key", mask(o.ApiKey)),
+		slog.Any("auth", maskAuth(o.Auth)),
+		slog.String("pipeline", o.Pipeline),
+		slog.Bool("insecure_skip_verify", o.InsecureSkipVerify),
+		slog.String("proxy", maskURL(o.Proxy)),
+		slog.Duration("request_timeout", o.RequestTimeout),
+		slog.String("log_body", o.LogBody),
+	)
+}
+
+// validLogBody checks a request body log policy.
+func validLogBody(policy string) error {
+	switch policy {
+	case "", "full", "none", "hash":
+		return nil
+	}
+	if n, err := strconv.Atoi(policy); err != nil || n < 0 {
+		return ErrInvalidLogBody
+	}
+	return nil
+}
+
+// loggedBody applies the configured log policy to a request body or document,
+// which may contain personal data.
+func (o *Options) loggedBody(body string) string {
+	return loggedBody(o.LogBody, body)
+}
+
+// loggedBody applies a log policy to a request body or document.
+func loggedBody(policy, body string) string {
+	switch policy {
+	case "", "full":
+		return body
+	case "none":
+		return fmt.Sprintf("[%d bytes omitted]", len(body))
+	case "hash":
+		return fmt.Sprintf("[%d bytes, sha256:%x]", len(body), sha256.Sum256([]byte(body)))
+	}
+	n, err := strconv.Atoi(policy)
+	if err != nil || n < 0 {
+		return fmt.Sprintf("[%d bytes omitted]", len(body))
+	}
+	if len(body) <= n {
+		return body
+	}
+	return fmt.Sprintf("%s... [%d bytes truncated]", body[:n], len(body)-n)
+}
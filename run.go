@@ -23,21 +23,25 @@ package esbulk
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/segmentio/encoding/json"
+	"github.com/sethgrid/pester"
 )
 
 var (
@@ -47,43 +51,102 @@ var (
 	ErrIndexNameRequired = errors.New("index name required")
 	ErrNoWorkers         = errors.New("no workers configured")
 	ErrInvalidBatchSize  = errors.New("cannot use zero batch size")
+	ErrSyncRequiresID    = errors.New("sync requires an id field")
+	ErrMappingConflict   = errors.New("cannot use mapping and infer mapping together")
+	ErrCloudIDConflict   = errors.New("cannot use cloud id and servers together")
+	ErrOrderedRequiresID = errors.New("ordered delivery requires an id field")
+	ErrOrderedTransform  = errors.New("cannot use ordered delivery and transform together")
 )
 
 // Runner bundles various options. Factored out of a former main func and
 // should be further split up (TODO).
 type Runner struct {
 	ApiKey             string
+	Auth               Authenticator // custom authenticator, used in addition to credentials
+	BearerToken        string        // token or @file to read it from
+	Headers            []string      // extra headers, as "Name: value"
 	BatchSize          int
 	Config             string
+	CloudID            string // Elastic Cloud ID, decoded into Servers
+	CompressRequests   bool
+	CompressLevel      int
 	CpuProfile         string
 	OpType             string
+	Ordered            bool // send documents with the same ID in input order
 	DocType            string
+	Dedup              string   // send only the first or last occurrence of an ID
+	DedupDB            string   // keep seen IDs in this file instead of memory
+	DefaultFields      []string // field=value to set, if missing or null
+	Exclude            string   // fields to remove, like "a,b.c"
 	File               *os.File
 	FileGzipped        bool
 	IdentifierField    string
+	IDHash             string // generate IDs with sha1 or xxhash
+	Include            string // fields to keep, like "a,b.c"
 	IndexName          string
+	InferMapping       int
+	InferNested        string // fields with arrays of objects to infer as nested
 	Mapping            string
 	MemProfile         string
+	MetricsAddr        string
+	NetrcFile          string
 	NumWorkers         int
 	Password           string
 	Pipeline           string
+	Progress           bool
+	DryRun             bool
+	DryRunSamples      string
 	Purge              bool
+	RenameFields       []string // old:new
+	ReportFile         string
+	RestoreOnly        bool // only restore refresh interval and flush, e.g. after a crash
+	RestoreSettings    bool // only restore the settings recorded in the state file
+	StateFile          string
 	PurgePause         time.Duration
 	RefreshInterval    string
 	Scheme             string
 	Servers            []string
+	ServerSelection    string   // round-robin (default) or least-in-flight
+	SetFields          []string // field=value to set, see FieldEditor
 	Settings           string
 	ShowVersion        bool
 	SkipBroken         bool
+	Sniff              bool          // discover cluster nodes and spread requests across them
+	SniffInterval      time.Duration // default: 5m
+	SniffRoles         []string      // default: data, ingest
+	SyncFile           string
+	Transform          Transform     // custom transform, applied after the others
+	TransformScript    string        // JavaScript file with a transform function
+	TransformTimeout   time.Duration // per document, for TransformScript
 	Username           string
 	Verbose            bool
+	Logger             *slog.Logger
+	LogBody            string
 	InsecureSkipVerify bool
+	CACert             string
+	ClientCert         string
+	ClientKey          string
+	TLSServerName      string
+	TLSMinVersion      string
+	AWSRegion          string
+	AWSService         string
+	Proxy              string
 	ZeroReplica        bool
 	// Request timeout for HTTP operations
 	RequestTimeout time.Duration
 	// Context for cancellation
 	ctx    context.Context
 	cancel context.CancelFunc
+	// Input reader and documents already read from it, e.g. for inspection,
+	// with their line numbers.
+	reader       *bufio.Reader
+	lineNo       int
+	sampled      []string
+	sampledLines []int
+	stats        *Stats
+	restorer     *settingsRestorer
+	dedup        *dedupIndex
+	editor       *FieldEditor
 }
 
 // Run starts indexing documents from file into a given index.
@@ -96,19 +159,61 @@ func (r *Runner) Run() (err error) {
 	r.ctx, r.cancel = context.WithCancel(context.Background())
 	defer r.cancel()
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// The report is written last, after all settings have been restored.
+	var (
+		started                   = time.Now()
+		loadStarted, loadFinished time.Time
+	)
+	r.stats = NewStats()
+	r.restorer = &settingsRestorer{}
+	if r.ReportFile != "" {
+		defer func() {
+			if werr := r.writeReport(started, loadStarted, loadFinished, err); werr != nil {
+				r.log().Error("failed to write report", "err", werr)
+				if err == nil {
+					err = werr
+				}
+			}
+		}()
+	}
 
+	// The first signal cancels the run, which then restores index settings
+	// on its way out. A second signal restores them right away and exits.
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		sig := <-sigChan
-		if r.Verbose {
-			log.Printf("received signal %v, initiating graceful shutdown", sig)
+		for i := 0; ; i++ {
+			var sig os.Signal
+			select {
+			case <-done:
+				return
+			case sig = <-sigChan:
+			}
+			if i == 0 {
+				r.log().Warn("received signal, initiating graceful shutdown", "signal", sig)
+				r.cancel()
+				continue
+			}
+			r.log().Warn("received second signal, restoring index settings and exiting", "signal", sig)
+			if err := r.restoreSettings(); err != nil {
+				os.Exit(1)
+			}
+			os.Exit(130)
 		}
-		r.cancel()
 	}()
 	if r.NumWorkers == 0 {
 		return ErrNoWorkers
 	}
+	if r.MetricsAddr != "" {
+		srv, err := ServeMetrics(r.MetricsAddr, r.stats)
+		if err != nil {
+			return fmt.Errorf("failed to serve metrics: %w", err)
+		}
+		defer srv.Close()
+	}
 	if r.BatchSize == 0 {
 		return ErrInvalidBatchSize
 	}
@@ -120,19 +225,89 @@ func (r *Runner) Run() (err error) {
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
+	var state *SettingsState
+	if r.RestoreSettings {
+		if r.StateFile == "" && r.IndexName == "" {
+			return ErrIndexNameRequired
+		}
+		if state, err = ReadSettingsState(r.stateFile()); err != nil {
+			return err
+		}
+		if r.IndexName == "" {
+			r.IndexName = state.Index
+		}
+		if len(r.Servers) == 0 && r.CloudID == "" {
+			r.Servers = state.Servers
+		}
+	}
 	if r.IndexName == "" {
 		return ErrIndexNameRequired
 	}
 	if r.OpType == "" {
 		r.OpType = "index"
 	}
+	if r.CloudID != "" {
+		if len(r.Servers) > 0 {
+			return ErrCloudIDConflict
+		}
+		server, err := DecodeCloudID(r.CloudID)
+		if err != nil {
+			return err
+		}
+		r.Servers = []string{server}
+	}
 	if len(r.Servers) == 0 {
 		r.Servers = append(r.Servers, "http://localhost:9200")
 	}
+	if r.SyncFile != "" && r.IdentifierField == "" && r.IDHash == "" {
+		return ErrSyncRequiresID
+	}
+	if r.Ordered && r.IdentifierField == "" && r.IDHash == "" {
+		return ErrOrderedRequiresID
+	}
+	// Documents are assigned to workers by their ID before the workers
+	// transform them, which may change the ID.
+	if r.Ordered && (r.TransformScript != "" || r.Transform != nil) {
+		return ErrOrderedTransform
+	}
+	if r.IDHash != "" {
+		if _, err := newIDHash(r.IDHash); err != nil {
+			return err
+		}
+	}
+	switch r.Dedup {
+	case "", DedupFirst, DedupLast:
+	default:
+		return ErrInvalidDedup
+	}
+	if r.Dedup != "" && r.IdentifierField == "" && r.IDHash == "" {
+		return ErrDedupRequiresID
+	}
+	if r.Mapping != "" && r.InferMapping > 0 {
+		return ErrMappingConflict
+	}
+	if err := validLogBody(r.LogBody); err != nil {
+		return err
+	}
+	if err := validCompressLevel(r.CompressLevel); err != nil {
+		return err
+	}
 	r.Servers = mapString(prependSchema, r.Servers)
-	if r.Verbose {
-		log.Printf("using %d server(s)", len(r.Servers))
+	if err := r.resolveCredentials(); err != nil {
+		return err
+	}
+	auth, err := r.authenticator()
+	if err != nil {
+		return err
 	}
+	transform, err := r.transform()
+	if err != nil {
+		return err
+	}
+	if r.editor, err = r.fieldEditor(); err != nil {
+		return err
+	}
+	r.log().Debug("using servers", "servers", r.Servers)
 	options := Options{
 		Servers:            r.Servers,
 		Index:              r.IndexName,
@@ -140,27 +315,114 @@ func (r *Runner) Run() (err error) {
 		DocType:            r.DocType,
 		BatchSize:          r.BatchSize,
 		Verbose:            r.Verbose,
+		Logger:             r.Logger,
+		LogBody:            r.LogBody,
 		Scheme:             "http", // deprecated
 		IDField:            r.IdentifierField,
+		IDHash:             r.IDHash,
 		Username:           r.Username,
 		Password:           r.Password,
 		ApiKey:             r.ApiKey,
+		Auth:               auth,
 		Pipeline:           r.Pipeline,
 		InsecureSkipVerify: r.InsecureSkipVerify,
+		CACert:             r.CACert,
+		ClientCert:         r.ClientCert,
+		ClientKey:          r.ClientKey,
+		TLSServerName:      r.TLSServerName,
+		TLSMinVersion:      r.TLSMinVersion,
+		AWSRegion:          r.AWSRegion,
+		AWSService:         r.AWSService,
+		Proxy:              r.Proxy,
 		RequestTimeout:     r.RequestTimeout,
+		CompressRequests:   r.CompressRequests,
+		CompressLevel:      r.CompressLevel,
+		Stats:              r.stats,
+		Transform:          transform,
+		SourceFilter:       r.sourceFilter(),
+		SkipBroken:         r.SkipBroken,
 	}
 	// Build a single HTTP client and share it across all requests so that
 	// connections are reused (keep-alive) instead of re-established for every
 	// batch. Options is copied by value throughout, but HTTPClient is a
 	// pointer, so every copy shares this one client.
-	options.HTTPClient = CreateHTTPClient(options.InsecureSkipVerify, options.RequestTimeout)
-	if r.Verbose {
-		log.Println(options)
+	if options.HTTPClient, err = NewHTTPClient(options.clientConfig()); err != nil {
+		return fmt.Errorf("failed to create http client: %w", err)
+	}
+	options.HTTPClient.LogHook = func(e pester.ErrEntry) {
+		// The hook sees every failed attempt, including the last one.
+		if e.Attempt < options.HTTPClient.MaxRetries {
+			r.stats.Retries.Add(1)
+		}
+	}
+	if options.Pool, err = NewServerPool(r.Servers, r.ServerSelection); err != nil {
+		return err
+	}
+	options.Pool.Logger = r.log()
+	r.log().Debug("options", "options", options)
+	if r.DryRun {
+		return r.dryRun(options)
+	}
+	if r.RestoreOnly {
+		if err := r.restoreIndex(options, nil); err != nil {
+			return err
+		}
+		// The settings have been restored by hand, a state file is obsolete.
+		if err := os.Remove(r.stateFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.log().Warn("failed to remove state file", "state", r.stateFile(), "err", err)
+		}
+		return nil
+	}
+	if r.RestoreSettings {
+		return r.restoreFromState(options, state)
+	}
+	// Only one run at a time changes and restores the index settings. Others,
+	// e.g. loading other parts of the input in parallel, leave them alone.
+	holder, err := r.lockState()
+	if err != nil {
+		return err
+	}
+	if holder == nil {
+		defer r.unlockState()
+		// The state file of a run, that did not finish, holds the original
+		// settings. Recording the current ones instead, e.g. zero replicas,
+		// would lose them.
+		if _, err := os.Stat(r.stateFile()); err == nil {
+			return fmt.Errorf("%w: %s, run esbulk restore-settings first", ErrStateFileExists, r.stateFile())
+		}
+	} else {
+		r.log().Info("index settings are managed by another esbulk run", "index", r.IndexName, "pid", holder.Pid)
+	}
+	go options.Pool.Probe(r.ctx, serverProbeInterval, func(ctx context.Context, server string) error {
+		return pingServer(ctx, server, options)
+	})
+	if r.Sniff {
+		if err := r.sniff(options); err != nil {
+			return err
+		}
+	}
+	if r.SyncFile != "" {
+		store, err := OpenSyncStore(r.SyncFile, r.syncScope())
+		if err != nil {
+			return fmt.Errorf("failed to open sync store: %w", err)
+		}
+		defer store.Close()
+		if store.rescoped {
+			r.log().Warn("sync store was used with another index or filter, sending all documents",
+				"sync_file", r.SyncFile, "index", r.IndexName)
+		}
+		options.SyncStore = store
 	}
 	if r.Purge {
 		if err := DeleteIndex(options); err != nil {
 			return err
 		}
+		// The index is empty now, so no document has been sent before.
+		if options.SyncStore != nil {
+			if err := options.SyncStore.Reset(); err != nil {
+				return fmt.Errorf("failed to reset sync store: %w", err)
+			}
+		}
 		time.Sleep(r.PurgePause)
 	}
 	var createIndexBody io.Reader
@@ -195,12 +457,209 @@ func (r *Runner) Run() (err error) {
 		if err != nil {
 			return err
 		}
+	} else if r.InferMapping > 0 {
+		inferred, err := r.inferMapping(options)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(inferred.Mapping)
+		if err != nil {
+			return err
+		}
+		r.log().Debug("inferred mapping", "index", options.Index, "docs", inferred.NumDocs, "mapping", string(b))
+		if err := PutMapping(options, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	// The dedup index is opened, and for -dedup last the input scanned, while
+	// the index settings are still untouched, so a long scan or a failure
+	// here leaves no replicas or refresh interval to restore.
+	if r.Dedup != "" {
+		if err := r.openDedup(options); err != nil {
+			return err
+		}
+		defer r.dedup.Close()
+	}
+	// Index settings are changed once for the whole cluster and restored on
+	// the way out, even if indexing failed.
+	defer func() {
+		if rerr := r.restoreSettings(); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+	}()
+	if holder == nil {
+		if err := r.prepareIndex(options); err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	loadStarted = start
+	counter, err := r.load(options)
+	loadFinished = time.Now()
+	if err != nil {
+		return err
+	}
+
+	// Only with the complete input indexed, we know which documents are gone.
+	if options.SyncStore != nil {
+		deleted, err := options.SyncStore.DeleteStale(r.ctx, options)
+		if err != nil {
+			return fmt.Errorf("failed to delete stale documents: %w", err)
+		}
+		r.log().Debug("sync finished", "index", options.Index,
+			"unchanged", options.SyncStore.Unchanged(), "deleted", deleted)
+	}
+
+	elapsed := time.Since(start)
+	if r.MemProfile != "" {
+		f, err := os.Create(r.MemProfile)
+		if err != nil {
+			return err
+		}
+		pprof.WriteHeapProfile(f)
+		f.Close()
+	}
+	if logger := r.log(); logger.Enabled(context.Background(), slog.LevelDebug) {
+		elapsed := elapsed.Seconds()
+		if elapsed < 0.1 {
+			elapsed = 0.1
+		}
+		rate := float64(counter) / elapsed
+		logger.Debug("indexing finished", "index", options.Index, "docs", counter, "elapsed", elapsed, "rate", rate, "workers", r.NumWorkers)
+	}
+	return nil
+}
+
+// prepareIndex disables refresh and, if requested, replicas for the duration
+// of the load. Before changing anything, the settings to restore are written
+// to the state file and a restore function is registered.
+func (r *Runner) prepareIndex(options Options) error {
+	server := options.server()
+	doc, err := getSettings(server, options)
+	if err != nil {
+		return err
+	}
+	numberOfReplicas, err := getNumberOfReplicas(doc, options.Index)
+	if err != nil {
+		return fmt.Errorf("failed to get number_of_replicas: %w", err)
+	}
+	state := &SettingsState{
+		Index:           options.Index,
+		Servers:         r.Servers,
+		Created:         time.Now(),
+		RefreshInterval: r.RefreshInterval,
+	}
+	var replicas any
+	if r.ZeroReplica {
+		replicas = numberOfReplicas
+		state.NumberOfReplicas = fmt.Sprintf("%v", numberOfReplicas)
+	}
+	if err := state.WriteFile(r.stateFile()); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	r.log().Debug("on shutdown, settings will be set back", "index", options.Index,
+		"number_of_replicas", numberOfReplicas, "refresh_interval", r.RefreshInterval,
+		"state", r.stateFile())
+	r.setRestore(func() error { return r.restoreIndex(options, replicas) })
+	if err := indexSettingsRequest(`{"index": {"refresh_interval": "-1"}}`, options); err != nil {
+		return fmt.Errorf("failed to disable refresh: %w", err)
+	}
+	if r.ZeroReplica {
+		if err := indexSettingsRequest(`{"index": {"number_of_replicas": 0}}`, options); err != nil {
+			return fmt.Errorf("failed to set number_of_replicas to 0: %w", err)
+		}
+	}
+	return nil
+}
+
+// restoreIndex sets the refresh interval, the number of replicas, if not nil,
+// and flushes the index. All steps are attempted, even if one fails.
+func (r *Runner) restoreIndex(options Options, replicas any) error {
+	var errs []error
+	if err := indexSettingsRequest(fmt.Sprintf(`{"index": {"refresh_interval": %q}}`, r.RefreshInterval), options); err != nil {
+		errs = append(errs, fmt.Errorf("failed to restore refresh_interval to %s: %w", r.RefreshInterval, err))
+	}
+	if replicas != nil {
+		if err := indexSettingsRequest(fmt.Sprintf(`{"index": {"number_of_replicas": "%v"}}`, replicas), options); err != nil {
+			errs = append(errs, fmt.Errorf("failed to restore number_of_replicas to %v: %w", replicas, err))
+		}
+	}
+	if err := flushIndex(options.server(), options); err != nil {
+		errs = append(errs, fmt.Errorf("failed to flush index: %w", err))
+	}
+	if len(errs) == 0 {
+		r.log().Info("restored index settings", "index", options.Index,
+			"refresh_interval", r.RefreshInterval, "number_of_replicas", replicas)
+	}
+	return errors.Join(errs...)
+}
+
+// dryRun runs the complete pipeline without sending anything and prints the
+// planned operations.
+func (r *Runner) dryRun(options Options) error {
+	plan, err := NewPlan(r.DryRunSamples)
+	if err != nil {
+		return fmt.Errorf("failed to create dry run samples file: %w", err)
+	}
+	defer plan.Close()
+	options.Plan = plan
+	if err := r.planSetup(plan, options); err != nil {
+		return err
+	}
+	if _, err := r.load(options); err != nil {
+		return err
 	}
+	_, err = plan.WriteTo(os.Stdout)
+	return err
+}
+
+// log returns the configured logger or a default one.
+func (r *Runner) log() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return defaultLogger(r.Verbose)
+}
+
+// writeReport writes a summary of the run to the report file. The setup phase
+// lasts until loading starts, teardown begins once loading has finished.
+func (r *Runner) writeReport(started, loadStarted, loadFinished time.Time, err error) error {
 	var (
-		queue   = make(chan string)
+		now    = time.Now()
+		report = r.stats.Report()
+	)
+	report.Index = r.IndexName
+	report.Started = started
+	report.Finished = now
+	report.ExitReason = exitReason(err)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	switch {
+	case loadStarted.IsZero():
+		report.Phases.Setup = now.Sub(started).Seconds()
+	case loadFinished.IsZero():
+		report.Phases.Setup = loadStarted.Sub(started).Seconds()
+		report.Phases.Load = now.Sub(loadStarted).Seconds()
+	default:
+		report.Phases.Setup = loadStarted.Sub(started).Seconds()
+		report.Phases.Load = loadFinished.Sub(loadStarted).Seconds()
+		report.Phases.Teardown = now.Sub(loadFinished).Seconds()
+	}
+	return report.WriteFile(r.ReportFile)
+}
+
+// load starts the workers, feeds them with documents from the input and waits
+// for all of them to finish. Returns the number of documents read.
+func (r *Runner) load(options Options) (int, error) {
+	var (
+		// The queue holds up to one batch, so the reader can stay ahead of
+		// the workers a bit; its length tells which side is slower.
+		queue   = make(chan string, r.BatchSize)
 		wg      sync.WaitGroup
 		errChan = make(chan error, r.NumWorkers)
 	)
+	r.stats.setQueueDepth(func() int { return len(queue) })
 	// Collect worker errors concurrently. A worker can emit more than one
 	// error (one per failed batch), so draining errChan only after wg.Wait
 	// would let the buffered channel fill, block the workers, and in turn
@@ -213,157 +672,299 @@ func (r *Runner) Run() (err error) {
 	errWG.Go(func() {
 		for err := range errChan {
 			workerErrors = append(workerErrors, err)
-			if r.Verbose {
-				log.Printf("worker error: %v", err)
-			}
+			r.log().Error("worker error", "index", options.Index, "err", err)
 		}
 	})
+	// With ordered delivery, each worker gets its own queue and documents
+	// with the same ID always go to the same worker, in input order.
+	workerQueues := make([]chan string, r.NumWorkers)
+	for i := range workerQueues {
+		workerQueues[i] = queue
+	}
+	if r.Ordered {
+		for i := range workerQueues {
+			workerQueues[i] = make(chan string, r.BatchSize)
+		}
+		go partitionLines(r.ctx, queue, workerQueues, options)
+	}
 	wg.Add(r.NumWorkers)
 	for i := 0; i < r.NumWorkers; i++ {
 		name := fmt.Sprintf("worker-%d", i)
-		go Worker(r.ctx, name, options, queue, &wg, errChan)
+		go Worker(r.ctx, name, options, workerQueues[i], &wg, errChan)
 	}
-	if r.Verbose {
-		log.Printf("started %d workers", r.NumWorkers)
+	r.log().Debug("started workers", "workers", r.NumWorkers)
+	var stopProgress = func() {}
+	if r.Progress {
+		stopProgress = r.startProgress()
 	}
-	for i := range options.Servers {
-		// Store number_of_replicas settings for restoration later.
-		doc, err := GetSettings(i, options)
-		if err != nil {
-			return err
-		}
-		numberOfReplicas, err := getNumberOfReplicas(doc, options.Index)
-		if err != nil {
-			return fmt.Errorf("failed to get number_of_replicas: %w", err)
-		}
-		if r.Verbose {
-			log.Printf("on shutdown, number_of_replicas will be set back to %s", numberOfReplicas)
-		}
-		if r.Verbose {
-			log.Printf("on shutdown, refresh_interval will be set back to %s", r.RefreshInterval)
+	counter, err := r.readLines(queue, options)
+	close(queue)
+	wg.Wait()
+	close(errChan)
+	errWG.Wait() // wait for the collector to finish draining errChan
+	stopProgress()
+	if err != nil {
+		return counter, err
+	}
+
+	// Check for context cancellation first
+	select {
+	case <-r.ctx.Done():
+		r.log().Debug("operation cancelled due to context")
+		return counter, r.ctx.Err()
+	default:
+		// Continue with error checking
+	}
+
+	// If any worker errors occurred, return them.
+	if len(workerErrors) > 0 {
+		msgs := make([]string, len(workerErrors))
+		for i, e := range workerErrors {
+			msgs[i] = e.Error()
 		}
-		// Shutdown procedure. TODO(miku): Handle signals, too.
-		defer func() {
-			// Realtime search.
-			if err = indexSettingsRequest(fmt.Sprintf(`{"index": {"refresh_interval": "%s"}}`, r.RefreshInterval), options); err != nil {
-				return
-			}
-			// Reset number of replicas.
-			if err = indexSettingsRequest(fmt.Sprintf(`{"index": {"number_of_replicas": %q}}`, numberOfReplicas), options); err != nil {
-				return
-			}
-			// Persist documents.
-			err = FlushIndex(i, options)
-		}()
-		// Realtime search.
-		if err := indexSettingsRequest(`{"index": {"refresh_interval": "-1"}}`, options); err != nil {
-			return err
+		return counter, fmt.Errorf("worker errors occurred: %s", strings.Join(msgs, "; "))
+	}
+	return counter, nil
+}
+
+// partitionLines distributes lines onto queues by a hash of their document ID
+// and closes the queues, once all lines are distributed. Lines without a
+// valid ID all go to the first queue, to fail there.
+func partitionLines(ctx context.Context, lines <-chan string, queues []chan string, options Options) {
+	defer func() {
+		for _, q := range queues {
+			close(q)
 		}
-		if r.ZeroReplica {
-			// Reset number of replicas.
-			if err := indexSettingsRequest(`{"index": {"number_of_replicas": 0}}`, options); err != nil {
-				return err
-			}
+	}()
+	for line := range lines {
+		i := xxhash.Sum64String(partitionKey(line, options)) % uint64(len(queues))
+		select {
+		case <-ctx.Done():
+			return
+		case queues[i] <- line:
 		}
 	}
+}
+
+// partitionKey returns a string, that is equal for documents with the same
+// ID. The ID fields are only scanned, not decoded, and a document hashed as a
+// whole is its own key. Documents without an ID share the empty key.
+func partitionKey(doc string, options Options) string {
+	if options.IDField == "" {
+		return doc
+	}
 	var (
-		reader  = bufio.NewReader(r.File)
-		counter = 0
-		start   = time.Now()
+		b   = []byte(doc)
+		key strings.Builder
 	)
-	if r.FileGzipped {
-		zreader, err := gzip.NewReader(r.File)
-		if err != nil {
-			return fmt.Errorf("failed to create gzip reader: %w", err)
+	for _, field := range strings.FieldsFunc(options.IDField, func(r rune) bool { return r == ',' || r == ' ' }) {
+		v, err := scanField(b, skipSpace(b, 0), strings.Split(field, "."))
+		if err != nil || v == nil {
+			return ""
+		}
+		if v[0] == '"' {
+			s, err := decodeKey(v)
+			if err != nil {
+				return ""
+			}
+			key.WriteString(s)
+		} else {
+			key.Write(v)
 		}
-		reader = bufio.NewReader(zreader)
 	}
-	if r.Verbose && r.File != nil {
-		log.Printf("start reading from %v", r.File.Name())
+	return key.String()
+}
+
+// readLines reads documents from the input and sends them to the queue, until
+// the input is exhausted or the context is cancelled. Returns the number of
+// documents queued. Fields are edited here, since only the reader knows the
+// line number of a document.
+func (r *Runner) readLines(queue chan<- string, options Options) (int, error) {
+	reader, err := r.input()
+	if err != nil {
+		return 0, err
+	}
+	if r.File != nil {
+		r.log().Debug("start reading", "file", r.File.Name())
 	}
+	var (
+		counter      = 0
+		sampled      = r.sampled
+		sampledLines = r.sampledLines
+	)
+	r.sampled, r.sampledLines = nil, nil
 readLoop:
 	for {
 		select {
 		case <-r.ctx.Done():
 			// Context cancelled, stop reading
-			if r.Verbose {
-				log.Printf("stopping document reading due to context cancellation")
-			}
+			r.log().Debug("stopping document reading due to context cancellation")
 			break readLoop
 		default:
-			line, err := reader.ReadString('\n')
-			if err == io.EOF {
-				break readLoop
-			}
-			if err != nil {
-				return err
-			}
-			if line = strings.TrimSpace(line); len(line) == 0 {
-				continue
+			var (
+				line   string
+				lineNo int
+			)
+			if len(sampled) > 0 {
+				// Documents already read for inspection go first.
+				line, sampled = sampled[0], sampled[1:]
+				lineNo, sampledLines = sampledLines[0], sampledLines[1:]
+			} else {
+				line, err = r.nextLine(reader)
+				if err == io.EOF {
+					break readLoop
+				}
+				if err != nil {
+					return counter, err
+				}
+				lineNo = r.lineNo
 			}
-			if r.SkipBroken {
-				if !(isJSON(line)) {
-					if r.Verbose {
-						fmt.Printf("skipped line [%s]\n", line)
+			doc := line
+			if r.editor != nil {
+				edited, err := r.editor.Edit(line, lineNo)
+				if err != nil {
+					err = fmt.Errorf("line %d: %w", lineNo, err)
+					switch {
+					case options.Plan != nil:
+						options.Plan.recordFailure(err)
+					case r.SkipBroken:
+						r.stats.recordSkipped()
+						r.log().Debug("skipping document", "err", err)
+					default:
+						return counter, err
 					}
 					continue
 				}
+				doc = edited
+			}
+			if r.dedup != nil {
+				keep, err := r.dedup.keep(doc, line)
+				if err != nil {
+					return counter, err
+				}
+				if !keep {
+					r.stats.Duplicates.Add(1)
+					continue
+				}
 			}
 			select {
-			case queue <- line:
+			case queue <- doc:
 				counter++
+				r.stats.DocsRead.Add(1)
 			case <-r.ctx.Done():
 				// Context cancelled while trying to send to queue
-				if r.Verbose {
-					log.Printf("stopping document reading due to context cancellation")
-				}
+				r.log().Debug("stopping document reading due to context cancellation")
 				break readLoop
 			}
 		}
 	}
-	close(queue)
-	wg.Wait()
-	close(errChan)
-	errWG.Wait() // wait for the collector to finish draining errChan
+	return counter, nil
+}
 
-	// Check for context cancellation first
-	select {
-	case <-r.ctx.Done():
-		if r.Verbose {
-			log.Printf("operation cancelled due to context")
+// input returns a buffered reader for the input file, decompressing it on the
+// fly if required. The reader is created once and shared by all consumers.
+func (r *Runner) input() (*bufio.Reader, error) {
+	if r.reader != nil {
+		return r.reader, nil
+	}
+	r.lineNo = 0
+	var file io.Reader = &countingReader{r: r.File, n: &r.stats.BytesRead}
+	if r.FileGzipped {
+		zreader, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 		}
-		return r.ctx.Err()
-	default:
-		// Continue with error checking
+		r.reader = bufio.NewReader(zreader)
+	} else {
+		r.reader = bufio.NewReader(file)
 	}
+	return r.reader, nil
+}
 
-	// If any worker errors occurred, return them.
-	if len(workerErrors) > 0 {
-		msgs := make([]string, len(workerErrors))
-		for i, e := range workerErrors {
-			msgs[i] = e.Error()
+// nextLine returns the next non-empty line from the input, skipping broken
+// JSON if requested, and sets lineNo to its line number. Returns io.EOF at
+// the end of the input.
+func (r *Runner) nextLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		r.lineNo++
+		if line = strings.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		if r.SkipBroken {
+			if !(isJSON(line)) {
+				r.stats.SkippedBroken.Add(1)
+				r.log().Debug("skipped broken line", "line", loggedBody(r.LogBody, line))
+				continue
+			}
 		}
-		return fmt.Errorf("worker errors occurred: %s", strings.Join(msgs, "; "))
+		return line, nil
 	}
+}
 
-	elapsed := time.Since(start)
-	if r.MemProfile != "" {
-		f, err := os.Create(r.MemProfile)
+// inferMapping infers a mapping from the first documents of the input. The
+// sampled documents are kept and indexed first, once loading starts. The
+// mapping is inferred from the documents as they are sent, after field edits,
+// transforms and source filters; lines failing any of these are left out.
+func (r *Runner) inferMapping(options Options) (*MappingInference, error) {
+	reader, err := r.input()
+	if err != nil {
+		return nil, err
+	}
+	for len(r.sampled) < r.InferMapping {
+		line, err := r.nextLine(reader)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			return err
+			return nil, err
 		}
-		pprof.WriteHeapProfile(f)
-		f.Close()
+		r.sampled = append(r.sampled, line)
+		r.sampledLines = append(r.sampledLines, r.lineNo)
 	}
-	if r.Verbose {
-		elapsed := elapsed.Seconds()
-		if elapsed < 0.1 {
-			elapsed = 0.1
+	var docs []string
+	for i, line := range r.sampled {
+		doc := line
+		if r.editor != nil {
+			edited, err := r.editor.Edit(line, r.sampledLines[i])
+			if err != nil {
+				continue
+			}
+			doc = edited
+		}
+		transformed, err := options.transform(doc)
+		if err != nil {
+			continue
+		}
+		for _, doc := range transformed {
+			if options.IDField != "" {
+				_, updated, err := documentID(doc, options)
+				if err != nil {
+					continue
+				}
+				if updated != "" {
+					doc = updated // without _id
+				}
+			}
+			if options.SourceFilter != nil {
+				if doc, err = options.filterSource(doc); err != nil {
+					continue
+				}
+			}
+			docs = append(docs, doc)
 		}
-		rate := float64(counter) / elapsed
-		log.Printf("%d docs in %0.2fs at %0.3f docs/s with %d workers\n", counter, elapsed, rate, r.NumWorkers)
 	}
-	return nil
+	inferred, err := InferMappingDocs(docs, r.InferNested)
+	if err != nil {
+		return nil, fmt.Errorf("failed to infer mapping: %w", err)
+	}
+	for _, c := range inferred.Conflicts {
+		r.log().Warn("mapping conflict", "index", r.IndexName, "conflict", c)
+	}
+	return inferred, nil
 }
 
 // getNumberOfReplicas safely extracts the number_of_replicas setting from the Elasticsearch settings response.
@@ -405,7 +1006,7 @@ func getNumberOfReplicas(doc map[string]any, indexName string) (any, error) {
 // response body is always drained and closed; a non-2xx status is reported as
 // an error that includes the response body.
 func indexSettingsRequest(body string, options Options) error {
-	server := options.RandomServer()
+	server := options.server()
 	link := fmt.Sprintf("%s/%s/_settings", server, options.Index)
 
 	req, err := CreateHTTPRequest("PUT", link, strings.NewReader(body), options)
@@ -413,15 +1014,14 @@ func indexSettingsRequest(body string, options Options) error {
 		return err
 	}
 
-	resp, err := options.client().Do(req)
+	resp, err := options.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if options.Verbose {
-		log.Printf("applied setting: %s with status %s\n", body, resp.Status)
-	}
+	options.logger().Debug("applied setting", "index", options.Index, "server", server,
+		"setting", body, "status", resp.Status)
 	if resp.StatusCode >= 400 {
 		b, err := io.ReadAll(resp.Body)
 		if err != nil {
@@ -432,6 +1032,18 @@ func indexSettingsRequest(body string, options Options) error {
 	return nil
 }
 
+// countingReader counts the bytes read from an underlying reader.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
 // isJSON checks if a string is valid json.
 func isJSON(str string) bool {
 	var js json.RawMessage
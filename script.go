@@ -0,0 +1,218 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+var (
+	// ErrNoTransformFunction is returned, if a script does not define a
+	// transform function.
+	ErrNoTransformFunction = errors.New("script does not define a transform function")
+	// ErrInvalidScriptResult is returned, if a script returns something else
+	// than an object, an array of objects or null.
+	ErrInvalidScriptResult = errors.New("transform must return an object, an array of objects or null")
+)
+
+// scriptMaxCallStackSize limits the call depth in scripts, so that runaway
+// recursion fails the document instead of exhausting memory.
+const scriptMaxCallStackSize = 10000
+
+// ScriptTransform transforms documents with a JavaScript function, defined in
+// a script as:
+//
+//	function transform(doc) { ... }
+//
+// The function receives the parsed document and returns a document, an array
+// of documents to fan out or null to drop it. Each VM runs one document at a
+// time and VMs are reused, so there is about one VM per worker. Scripts are
+// interrupted, when the context is done or they run longer than the timeout.
+type ScriptTransform struct {
+	ctx     context.Context
+	timeout time.Duration
+	program *goja.Program
+	vms     chan *scriptVM
+}
+
+// scriptVM is a runtime with the script loaded.
+type scriptVM struct {
+	rt        *goja.Runtime
+	transform goja.Callable
+	parse     goja.Callable
+	stringify goja.Callable
+	JSON      goja.Value
+}
+
+// NewScriptTransform compiles the script in filename and keeps up to size
+// VMs for reuse, usually one per worker. A zero timeout means no timeout.
+func NewScriptTransform(ctx context.Context, filename string, size int, timeout time.Duration) (*ScriptTransform, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	program, err := goja.Compile(filename, string(b), false)
+	if err != nil {
+		return nil, err
+	}
+	t := &ScriptTransform{
+		ctx:     ctx,
+		timeout: timeout,
+		program: program,
+		vms:     make(chan *scriptVM, max(size, 1)),
+	}
+	// Run the script once, to fail early on errors at the top level or a
+	// missing function.
+	vm, err := t.newVM()
+	if err != nil {
+		return nil, err
+	}
+	t.vms <- vm
+	return t, nil
+}
+
+// newVM creates a runtime and runs the script in it.
+func (t *ScriptTransform) newVM() (*scriptVM, error) {
+	rt := goja.New()
+	rt.SetMaxCallStackSize(scriptMaxCallStackSize)
+	release := t.guard(rt)
+	_, err := rt.RunProgram(t.program)
+	if cause := release(); cause != nil {
+		return nil, fmt.Errorf("script interrupted: %w", cause)
+	}
+	if err != nil {
+		return nil, err
+	}
+	transform, ok := goja.AssertFunction(rt.Get("transform"))
+	if !ok {
+		return nil, ErrNoTransformFunction
+	}
+	JSON := rt.Get("JSON").ToObject(rt)
+	parse, _ := goja.AssertFunction(JSON.Get("parse"))
+	stringify, _ := goja.AssertFunction(JSON.Get("stringify"))
+	return &scriptVM{
+		rt:        rt,
+		transform: transform,
+		parse:     parse,
+		stringify: stringify,
+		JSON:      JSON,
+	}, nil
+}
+
+// Transform runs the transform function on a document.
+func (t *ScriptTransform) Transform(doc string) ([]string, error) {
+	var vm *scriptVM
+	select {
+	case vm = <-t.vms:
+	default:
+		var err error
+		if vm, err = t.newVM(); err != nil {
+			return nil, err
+		}
+	}
+	release := t.guard(vm.rt)
+	docs, err := vm.run(doc)
+	if cause := release(); cause != nil {
+		// An interrupted VM is dropped, as the interrupt may still be pending.
+		return nil, fmt.Errorf("transform interrupted: %w", cause)
+	}
+	select {
+	case t.vms <- vm:
+	default:
+	}
+	return docs, err
+}
+
+// guard interrupts a runtime, when the context is done or the timeout has
+// passed. The returned function stops the guard and returns the reason, if
+// the runtime has been interrupted.
+func (t *ScriptTransform) guard(rt *goja.Runtime) func() error {
+	ctx, cancel := t.ctx, context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	stop := context.AfterFunc(ctx, func() { rt.Interrupt(context.Cause(ctx)) })
+	return func() error {
+		defer cancel()
+		if stop() {
+			return nil
+		}
+		return context.Cause(ctx)
+	}
+}
+
+// run passes a document to the transform function and encodes the result.
+func (vm *scriptVM) run(doc string) ([]string, error) {
+	v, err := vm.parse(vm.JSON, vm.rt.ToValue(doc))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidDocument, err)
+	}
+	result, err := vm.transform(goja.Undefined(), v)
+	if err != nil {
+		return nil, err
+	}
+	if goja.IsNull(result) || goja.IsUndefined(result) {
+		return nil, nil
+	}
+	obj, ok := result.(*goja.Object)
+	if !ok {
+		return nil, ErrInvalidScriptResult
+	}
+	if obj.ClassName() != "Array" {
+		s, err := vm.encode(obj)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	var docs []string
+	for _, key := range obj.Keys() {
+		elem := obj.Get(key)
+		if goja.IsNull(elem) || goja.IsUndefined(elem) {
+			continue
+		}
+		s, err := vm.encode(elem)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, s)
+	}
+	return docs, nil
+}
+
+// encode returns the JSON encoding of an object.
+func (vm *scriptVM) encode(v goja.Value) (string, error) {
+	if obj, ok := v.(*goja.Object); !ok || obj.ClassName() == "Array" || obj.ClassName() == "Function" {
+		return "", ErrInvalidScriptResult
+	}
+	s, err := vm.stringify(vm.JSON, v)
+	if err != nil {
+		return "", err
+	}
+	return s.String(), nil
+}
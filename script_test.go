@@ -0,0 +1,194 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "transform.js")
+	if err := os.WriteFile(filename, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestScriptTransform(t *testing.T) {
+	script := writeScript(t, `
+function transform(doc) {
+	switch (doc.kind) {
+	case "drop":
+		return null;
+	case "split":
+		return doc.parts.map(p => ({id: doc.id + "-" + p}));
+	case "string":
+		return "x";
+	case "throw":
+		throw new Error("cannot handle " + doc.id);
+	}
+	doc.title = doc.title.toUpperCase();
+	return doc;
+}`)
+	st, err := NewScriptTransform(context.Background(), script, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		doc  string
+		want []string
+		err  error
+	}{
+		{`{"id": 1, "title": "a"}`, []string{`{"id":1,"title":"A"}`}, nil},
+		{`{"id": 1, "kind": "drop"}`, nil, nil},
+		{`{"id": 1, "kind": "split", "parts": ["a", "b"]}`, []string{`{"id":"1-a"}`, `{"id":"1-b"}`}, nil},
+		{`{"id": 1, "kind": "string"}`, nil, ErrInvalidScriptResult},
+		{`{"id": 1`, nil, ErrInvalidDocument},
+	}
+	for _, c := range cases {
+		got, err := st.Transform(c.doc)
+		if !errors.Is(err, c.err) {
+			t.Fatalf("%s: got %v, want %v", c.doc, err, c.err)
+		}
+		if strings.Join(got, " ") != strings.Join(c.want, " ") {
+			t.Fatalf("%s: got %v, want %v", c.doc, got, c.want)
+		}
+	}
+	if _, err := st.Transform(`{"id": 7, "kind": "throw"}`); err == nil || !strings.Contains(err.Error(), "cannot handle 7") {
+		t.Fatalf("got %v, want script error", err)
+	}
+	// Transforms run concurrently in the workers.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			for range 100 {
+				if got, err := st.Transform(`{"title": "b"}`); err != nil || got[0] != `{"title":"B"}` {
+					t.Errorf("got %v, %v", got, err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if _, err := NewScriptTransform(context.Background(), writeScript(t, `var x = 1;`), 1, 0); !errors.Is(err, ErrNoTransformFunction) {
+		t.Fatalf("got %v, want %v", err, ErrNoTransformFunction)
+	}
+	if _, err := NewScriptTransform(context.Background(), writeScript(t, `function transform(doc) {`), 1, 0); err == nil {
+		t.Fatal("got nil, want syntax error")
+	}
+}
+
+func TestScriptTransformInterrupt(t *testing.T) {
+	script := writeScript(t, `
+function down(n) { return down(n + 1); }
+function transform(doc) {
+	switch (doc.kind) {
+	case "loop":
+		for (;;) {}
+	case "recurse":
+		return down(0);
+	}
+	return doc;
+}`)
+	ctx, cancel := context.WithCancel(context.Background())
+	st, err := NewScriptTransform(ctx, script, 1, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Transform(`{"kind": "loop"}`); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	var overflow *goja.StackOverflowError
+	if _, err := st.Transform(`{"kind": "recurse"}`); !errors.As(err, &overflow) {
+		t.Fatalf("got %v, want stack overflow", err)
+	}
+	if got, err := st.Transform(`{"id": 1}`); err != nil || len(got) != 1 {
+		t.Fatalf("got %v, %v after interrupt", got, err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	st.timeout = 0
+	if _, err := st.Transform(`{"kind": "loop"}`); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+	loop := writeScript(t, `for (;;) {} function transform(doc) { return doc; }`)
+	if _, err := NewScriptTransform(context.Background(), loop, 1, 100*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestRunTransformScript(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	f, err := os.CreateTemp(t.TempDir(), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, `{"id": "1", "title": "a", "authors": [{"id": "x", "name": "X"}, {"id": "y", "name": "Y"}]}`)
+	fmt.Fprintln(f, `{"id": "2", "title": "b", "authors": []}`)
+	fmt.Fprintln(f, `{"id": "3", "title": "c", "authors": [{"id": "z", "name": "Z"}]}`)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	r := Runner{
+		Servers:          []string{ts.URL},
+		BatchSize:        10,
+		NumWorkers:       1,
+		RefreshInterval:  "1s",
+		IndexName:        "abc",
+		OpType:           "index",
+		File:             f,
+		StateFile:        filepath.Join(t.TempDir(), "state.json"),
+		IdentifierField:  "id",
+		Exclude:          "title",
+		TransformScript:  writeScript(t, `function transform(doc) { return doc.authors.map(a => ({id: doc.id + "-" + a.id, name: a.name, title: doc.title})); }`),
+		TransformTimeout: time.Second,
+	}
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// The script runs before -exclude, IDs are read from its results.
+	sources := cluster.sources
+	if got, want := cluster.reset(), []string{"index 1-x", "index 1-y", "index 3-z"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if want := []string{`{"id":"1-x","name":"X"}`, `{"id":"1-y","name":"Y"}`, `{"id":"3-z","name":"Z"}`}; !reflect.DeepEqual(sources, want) {
+		t.Fatalf("got %v, want %v", sources, want)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoAWSCredentials is returned, if no AWS credentials can be found.
+var ErrNoAWSCredentials = errors.New("no aws credentials found in environment or credentials file")
+
+// awsCredentialsInterval is how often credentials are loaded again, so that
+// temporary credentials, refreshed in the credentials file by another tool,
+// are picked up during long runs.
+const awsCredentialsInterval = time.Minute
+
+// AWSCredentials are used to sign requests with AWS signature version 4.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// LoadAWSCredentials reads credentials from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables, then from
+// the shared credentials file ($AWS_SHARED_CREDENTIALS_FILE or
+// ~/.aws/credentials), using the profile in $AWS_PROFILE or "default".
+func LoadAWSCredentials() (AWSCredentials, error) {
+	creds := AWSCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID != "" && creds.SecretAccessKey != "" {
+		return creds, nil
+	}
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return creds, ErrNoAWSCredentials
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	creds, err := readAWSCredentialsFile(filename, profile)
+	if errors.Is(err, os.ErrNotExist) {
+		return creds, ErrNoAWSCredentials
+	}
+	return creds, err
+}
+
+// readAWSCredentialsFile reads the credentials of a profile from an ini style
+// shared credentials file.
+func readAWSCredentialsFile(filename, profile string) (AWSCredentials, error) {
+	var creds AWSCredentials
+	f, err := os.Open(filename)
+	if err != nil {
+		return creds, err
+	}
+	defer f.Close()
+	var (
+		scanner = bufio.NewScanner(f)
+		section string
+	)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		case section != profile:
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return creds, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("%w: profile %s in %s", ErrNoAWSCredentials, profile, filename)
+	}
+	return creds, nil
+}
+
+// SigV4Signer signs requests with AWS signature version 4.
+type SigV4Signer struct {
+	Region      string
+	Service     string
+	Credentials AWSCredentials
+}
+
+// Sign signs a request with a given payload hash (hex encoded SHA-256) at
+// a given time. The host, content type and all x-amz-* headers are signed.
+func (s *SigV4Signer) Sign(req *http.Request, payloadHash string, t time.Time) {
+	var (
+		amzDate = t.UTC().Format("20060102T150405Z")
+		scope   = strings.Join([]string{amzDate[:8], s.Region, s.Service, "aws4_request"}, "/")
+	)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+	headers, signed := canonicalHeaders(req)
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.EscapedPath(), false),
+		canonicalQuery(req),
+		headers,
+		signed,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), amzDate[:8])
+	for _, v := range []string{s.Region, s.Service, "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.Credentials.AccessKeyID, scope, signed, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// canonicalHeaders returns the canonical headers and the list of signed
+// header names.
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for name, vs := range req.Header {
+		name = strings.ToLower(name)
+		if name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		for i, v := range vs {
+			vs[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[name] = strings.Join(vs, ",")
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + ":" + values[name] + "\n")
+	}
+	return sb.String(), strings.Join(names, ";")
+}
+
+// canonicalQuery returns the query string sorted by key and value.
+func canonicalQuery(req *http.Request) string {
+	var params []string
+	for key, values := range req.URL.Query() {
+		for _, v := range values {
+			params = append(params, awsEscape(key, true)+"="+awsEscape(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent-encodes all but unreserved characters, optionally keeping
+// slashes. Applied to an already escaped path, this yields the double encoding
+// expected by all services except S3.
+func awsEscape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sigV4Transport signs every request before passing it on.
+type sigV4Transport struct {
+	next    http.RoundTripper
+	region  string
+	service string
+	load    func() (AWSCredentials, error)
+
+	mu     sync.Mutex
+	creds  AWSCredentials
+	loaded time.Time
+}
+
+// newSigV4Transport loads the credentials and returns a transport, that
+// reloads them every awsCredentialsInterval.
+func newSigV4Transport(next http.RoundTripper, region, service string, load func() (AWSCredentials, error)) (*sigV4Transport, error) {
+	creds, err := load()
+	if err != nil {
+		return nil, err
+	}
+	return &sigV4Transport{
+		next:    next,
+		region:  region,
+		service: service,
+		load:    load,
+		creds:   creds,
+		loaded:  time.Now(),
+	}, nil
+}
+
+// signer returns a signer with the current credentials. If reloading fails,
+// e.g. while the credentials file is being rewritten, the previous
+// credentials are used until the next attempt.
+func (t *sigV4Transport) signer(now time.Time) *SigV4Signer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.loaded) >= awsCredentialsInterval {
+		if creds, err := t.load(); err == nil {
+			t.creds = creds
+		}
+		t.loaded = now
+	}
+	return &SigV4Signer{Region: t.region, Service: t.service, Credentials: t.creds}
+}
+
+// RoundTrip hashes the payload, signs a copy of the request and sends it.
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var payload []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body := req.Body
+		if req.GetBody != nil {
+			req.Body.Close()
+			b, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			body = b
+		}
+		b, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		payload = b
+	}
+	signed := req.Clone(req.Context())
+	if payload != nil {
+		signed.Body = io.NopCloser(bytes.NewReader(payload))
+	}
+	hash := sha256Hex(payload)
+	signed.Header.Set("X-Amz-Content-Sha256", hash)
+	now := time.Now()
+	t.signer(now).Sign(signed, hash, now)
+	return t.next.RoundTrip(signed)
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testAWSCredentials = AWSCredentials{
+	AccessKeyID:     "AKIDEXAMPLE",
+	SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+}
+
+// TestSigV4Vanilla checks the get-vanilla case from the AWS signature version
+// 4 test suite.
+func TestSigV4Vanilla(t *testing.T) {
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &SigV4Signer{Region: "us-east-1", Service: "service", Credentials: testAWSCredentials}
+	signer.Sign(req, sha256Hex(nil), time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, " +
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// sigV4Verifier checks payload hash and signature of every request, before
+// passing it on.
+type sigV4Verifier struct {
+	t      *testing.T
+	signer *SigV4Signer
+	next   http.Handler
+}
+
+func (v *sigV4Verifier) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	if got, want := r.Header.Get("X-Amz-Content-Sha256"), sha256Hex(body); got != want {
+		v.t.Errorf("payload hash: got %s, want %s", got, want)
+	}
+	t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	check := r.Clone(r.Context())
+	check.URL.Host = r.Host
+	check.Header.Del("Authorization")
+	v.signer.Sign(check, sha256Hex(body), t)
+	if got, want := r.Header.Get("Authorization"), check.Header.Get("Authorization"); got != want {
+		v.t.Errorf("signature: got %s, want %s", got, want)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	v.next.ServeHTTP(w, r)
+}
+
+func TestSigV4Transport(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", testAWSCredentials.AccessKeyID)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", testAWSCredentials.SecretAccessKey)
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+	var (
+		fake     = &fakeBulkServer{}
+		signer   = &SigV4Signer{Region: "eu-central-1", Service: "es", Credentials: testAWSCredentials}
+		verifier = &sigV4Verifier{t: t, signer: signer, next: fake}
+		ts       = httptest.NewServer(verifier)
+	)
+	defer ts.Close()
+	signer.Credentials.SessionToken = "token"
+	options := Options{
+		Servers:   []string{ts.URL},
+		Index:     "test index",
+		OpType:    "index",
+		BatchSize: 10,
+		IDField:   "id",
+		AWSRegion: "eu-central-1",
+	}
+	docs := []string{`{"id": "1"}`, `{"id": "2"}`}
+	if err := BulkIndex(context.Background(), docs, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.reset(); len(got) != 2 {
+		t.Fatalf("got %v, want two documents", got)
+	}
+}
+
+func TestSigV4TransportReload(t *testing.T) {
+	var (
+		keys  = []string{"first", "second"}
+		loads int
+		fail  bool
+	)
+	load := func() (AWSCredentials, error) {
+		if fail {
+			return AWSCredentials{}, ErrNoAWSCredentials
+		}
+		creds := AWSCredentials{AccessKeyID: keys[min(loads, len(keys)-1)], SecretAccessKey: "secret"}
+		loads++
+		return creds, nil
+	}
+	tr, err := newSigV4Transport(http.DefaultTransport, "eu-central-1", "es", load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := tr.loaded
+	var cases = []struct {
+		after time.Duration
+		fail  bool
+		want  string
+	}{
+		{0, false, "first"},
+		{awsCredentialsInterval / 2, false, "first"},
+		{awsCredentialsInterval, false, "second"},
+		{3 * awsCredentialsInterval, true, "second"}, // failed reload keeps credentials
+	}
+	for _, c := range cases {
+		fail = c.fail
+		if got := tr.signer(start.Add(c.after)).Credentials.AccessKeyID; got != c.want {
+			t.Errorf("after %s: got %s, want %s", c.after, got, c.want)
+		}
+	}
+	if loads != 2 {
+		t.Fatalf("got %d loads, want 2", loads)
+	}
+	if _, err := newSigV4Transport(http.DefaultTransport, "eu-central-1", "es", func() (AWSCredentials, error) {
+		return AWSCredentials{}, ErrNoAWSCredentials
+	}); !errors.Is(err, ErrNoAWSCredentials) {
+		t.Fatalf("got %v, want %v", err, ErrNoAWSCredentials)
+	}
+}
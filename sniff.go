@@ -0,0 +1,177 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// ErrNoNodes is returned, if sniffing found no nodes with a matching role.
+var ErrNoNodes = errors.New("no nodes with http enabled and matching roles found")
+
+// defaultSniffRoles are the roles of nodes used for bulk requests, if none
+// are given.
+var defaultSniffRoles = []string{"data", "ingest"}
+
+// nodesResponse is the part of a _nodes/http response we need.
+type nodesResponse struct {
+	Nodes map[string]struct {
+		Name  string   `json:"name"`
+		Roles []string `json:"roles"`
+		HTTP  struct {
+			PublishAddress string `json:"publish_address"`
+		} `json:"http"`
+	} `json:"nodes"`
+}
+
+// hasRole returns true, if a node has any of the given roles. The "data" role
+// also matches specialized data roles, like "data_hot".
+func hasRole(nodeRoles, roles []string) bool {
+	for _, role := range roles {
+		for _, r := range nodeRoles {
+			if r == role || (role == "data" && strings.HasPrefix(r, "data_")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// publishURL turns a publish address, "ip:port" or "hostname/ip:port", into a
+// URL with a given scheme, preferring the hostname.
+func publishURL(scheme, addr string) (string, error) {
+	host, ipport, ok := strings.Cut(addr, "/")
+	if !ok {
+		ipport = addr
+	}
+	ip, port, err := net.SplitHostPort(ipport)
+	if err != nil {
+		return "", err
+	}
+	if !ok || host == "" {
+		host = ip
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
+// SniffNodes asks the cluster for its nodes with http enabled and returns the
+// URLs of those with any of the given roles, data and ingest by default. The
+// scheme is taken from the server the request is sent to.
+func SniffNodes(ctx context.Context, options Options, roles []string) ([]string, error) {
+	var trimmed []string
+	for _, role := range roles {
+		if role = strings.TrimSpace(role); role != "" {
+			trimmed = append(trimmed, role)
+		}
+	}
+	roles = trimmed
+	if len(roles) == 0 {
+		roles = defaultSniffRoles
+	}
+	server := options.server()
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	req, err := CreateHTTPRequestWithContext(ctx, "GET", server+"/_nodes/http", nil, options)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := options.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sniffing failed with %s: %s", resp.Status, string(b))
+	}
+	var nr nodesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&nr); err != nil {
+		return nil, err
+	}
+	var servers []string
+	for id, node := range nr.Nodes {
+		if node.HTTP.PublishAddress == "" || !hasRole(node.Roles, roles) {
+			continue
+		}
+		s, err := publishURL(u.Scheme, node.HTTP.PublishAddress)
+		if err != nil {
+			options.logger().Warn("ignoring node with invalid publish address", "node", id,
+				"name", node.Name, "address", node.HTTP.PublishAddress)
+			continue
+		}
+		servers = append(servers, s)
+	}
+	if len(servers) == 0 {
+		return nil, ErrNoNodes
+	}
+	sort.Strings(servers)
+	return slices.Compact(servers), nil
+}
+
+// sniff updates the server pool with the nodes of the cluster, at startup and
+// then at every interval, until the context is done.
+func (r *Runner) sniff(options Options) error {
+	servers, err := SniffNodes(r.ctx, options, r.SniffRoles)
+	if err != nil {
+		return fmt.Errorf("failed to sniff nodes: %w", err)
+	}
+	r.log().Info("sniffed nodes", "servers", servers)
+	options.Pool.Update(servers)
+	interval := r.SniffInterval
+	if interval == 0 {
+		interval = 5 * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			servers, err := SniffNodes(r.ctx, options, r.SniffRoles)
+			if err != nil {
+				if r.ctx.Err() == nil {
+					r.log().Warn("failed to sniff nodes, keeping current servers", "err", err)
+				}
+				continue
+			}
+			r.log().Debug("sniffed nodes", "servers", servers)
+			options.Pool.Update(servers)
+		}
+	}()
+	return nil
+}
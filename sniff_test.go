@@ -0,0 +1,68 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSniffNodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_nodes/http" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"nodes": {
+			"a": {"name": "master", "roles": ["master"], "http": {"publish_address": "10.0.0.1:9200"}},
+			"b": {"name": "hot", "roles": ["data_hot", "master"], "http": {"publish_address": "es-hot/10.0.0.2:9200"}},
+			"c": {"name": "ingest", "roles": ["ingest"], "http": {"publish_address": "[::1]:9201"}},
+			"d": {"name": "nohttp", "roles": ["data"]}
+		}}`)
+	}))
+	defer ts.Close()
+	options := Options{Servers: []string{ts.URL}}
+	var cases = []struct {
+		roles []string
+		want  []string
+		err   error
+	}{
+		{nil, []string{"http://[::1]:9201", "http://es-hot:9200"}, nil},
+		{[]string{"master"}, []string{"http://10.0.0.1:9200", "http://es-hot:9200"}, nil},
+		{[]string{"ml"}, nil, ErrNoNodes},
+		{[]string{"ml", " ingest", ""}, []string{"http://[::1]:9201"}, nil},
+		{[]string{" "}, []string{"http://[::1]:9201", "http://es-hot:9200"}, nil},
+	}
+	for _, c := range cases {
+		got, err := SniffNodes(context.Background(), options, c.roles)
+		if err != c.err {
+			t.Fatalf("%v: got %v, want %v", c.roles, err, c.err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%v: got %v, want %v", c.roles, got, c.want)
+		}
+	}
+}
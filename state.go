@@ -0,0 +1,230 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/segmentio/encoding/json"
+)
+
+// ErrStateFileExists is returned, if a state file is left from a run, that
+// did not restore the index settings.
+var ErrStateFileExists = errors.New("state file exists, settings of a previous run have not been restored")
+
+// SettingsState records the index settings to restore after a load. It is
+// written to a file before any setting is changed, so that the settings can
+// be restored with "esbulk restore-settings", even if esbulk was killed.
+type SettingsState struct {
+	Index   string    `json:"index"`
+	Servers []string  `json:"servers"`
+	Created time.Time `json:"created"`
+	// RefreshInterval is the refresh interval to set after the load.
+	RefreshInterval string `json:"refresh_interval"`
+	// NumberOfReplicas is the original number of replicas, if it has been
+	// changed.
+	NumberOfReplicas string `json:"number_of_replicas,omitempty"`
+}
+
+// DefaultStateFile returns the default location of the settings state file
+// for an index on a cluster, in the user cache directory. The cluster is
+// given by its servers, in any order, or by an Elastic Cloud ID.
+func DefaultStateFile(index string, cluster ...string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	servers := mapString(prependSchema, cluster)
+	if len(servers) == 0 {
+		servers = []string{"http://localhost:9200"}
+	}
+	sort.Strings(servers)
+	name := fmt.Sprintf("settings-%s-%08x.json", index, uint32(xxhash.Sum64String(strings.Join(servers, " "))))
+	return filepath.Join(dir, "esbulk", name)
+}
+
+// ReadSettingsState reads a settings state file.
+func ReadSettingsState(filename string) (*SettingsState, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var state SettingsState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", filename, err)
+	}
+	if state.Index == "" {
+		return nil, fmt.Errorf("invalid state file %s: %w", filename, ErrIndexNameRequired)
+	}
+	return &state, nil
+}
+
+// WriteFile writes the state to a file, atomically, creating missing parent
+// directories.
+func (s *SettingsState) WriteFile(filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// stateFile returns the settings state file of the run.
+func (r *Runner) stateFile() string {
+	if r.StateFile != "" {
+		return r.StateFile
+	}
+	if r.CloudID != "" {
+		return DefaultStateFile(r.IndexName, r.CloudID)
+	}
+	return DefaultStateFile(r.IndexName, r.Servers...)
+}
+
+// stateLock is the content of the lock file, that marks the run changing the
+// settings of an index.
+type stateLock struct {
+	Pid  int    `json:"pid"`
+	Host string `json:"host"`
+}
+
+// lockState takes the lock on the index settings, a file next to the state
+// file with the process ID of the run. It returns the holder of the lock, if
+// another running esbulk process has it, e.g. one loading another part of
+// the input. A lock of a process that is gone is taken over.
+func (r *Runner) lockState() (*stateLock, error) {
+	filename := r.stateFile() + ".lock"
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	lock := stateLock{Pid: os.Getpid(), Host: host}
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = json.NewEncoder(f).Encode(lock)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			return nil, err
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return nil, fmt.Errorf("failed to lock %s: %w", filename, err)
+		}
+		var holder stateLock
+		if b, err := os.ReadFile(filename); err == nil && json.Unmarshal(b, &holder) == nil &&
+			holder.Host == host && processAlive(holder.Pid) {
+			return &holder, nil
+		}
+		r.log().Warn("removing stale lock", "lock", filename)
+		if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+}
+
+// unlockState releases the lock on the index settings.
+func (r *Runner) unlockState() {
+	if err := os.Remove(r.stateFile() + ".lock"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		r.log().Warn("failed to remove lock", "lock", r.stateFile()+".lock", "err", err)
+	}
+}
+
+// processAlive returns true, if a process with the given ID is running.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// settingsRestorer restores index settings from any exit path, but only once.
+type settingsRestorer struct {
+	mu      sync.Mutex
+	restore func() error
+	once    sync.Once
+	err     error
+}
+
+// setRestore registers the function restoring the index settings.
+func (r *Runner) setRestore(f func() error) {
+	r.restorer.mu.Lock()
+	defer r.restorer.mu.Unlock()
+	r.restorer.restore = f
+}
+
+// restoreSettings restores the index settings, if they have been changed. It
+// is called on every exit path, but only restores once; concurrent callers
+// wait for the first one to finish.
+func (r *Runner) restoreSettings() error {
+	rs := r.restorer
+	rs.mu.Lock()
+	f := rs.restore
+	rs.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	rs.once.Do(func() {
+		rs.err = f()
+		if rs.err != nil {
+			r.log().Error("failed to restore index settings, run esbulk restore-settings to retry",
+				"index", r.IndexName, "state", r.stateFile(), "err", rs.err)
+			return
+		}
+		if err := os.Remove(r.stateFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			r.log().Warn("failed to remove state file", "state", r.stateFile(), "err", err)
+		}
+	})
+	return rs.err
+}
+
+// restoreFromState restores the settings recorded in a state file and removes
+// the file on success.
+func (r *Runner) restoreFromState(options Options, state *SettingsState) error {
+	r.RefreshInterval = state.RefreshInterval
+	var replicas any
+	if state.NumberOfReplicas != "" {
+		replicas = state.NumberOfReplicas
+	}
+	r.setRestore(func() error { return r.restoreIndex(options, replicas) })
+	return r.restoreSettings()
+}
@@ -0,0 +1,307 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// Stats collects counters and timings during a run. A nil *Stats is valid and
+// records nothing, so library users do not need to set one up.
+type Stats struct {
+	DocsRead      atomic.Int64
+	DocsSent      atomic.Int64
+	Created       atomic.Int64
+	Updated       atomic.Int64
+	Deleted       atomic.Int64
+	Noop          atomic.Int64
+	Failed        atomic.Int64
+	SkippedBroken atomic.Int64
+	Unchanged     atomic.Int64
+	Duplicates    atomic.Int64
+	Retries       atomic.Int64
+	Batches       atomic.Int64
+	Bytes         atomic.Int64 // bulk request bodies, uncompressed
+	BytesSent     atomic.Int64 // bulk request bodies, as sent, maybe compressed
+	BytesRead     atomic.Int64 // input offset, before decompression
+	InFlight      atomic.Int64
+
+	mu         sync.Mutex
+	failures   map[string]int64
+	servers    map[string]*serverStats
+	queueDepth func() int
+}
+
+// serverStats records the requests sent to a single server.
+type serverStats struct {
+	requests  int64
+	errors    int64
+	latencies []time.Duration
+	bulk      histogram
+}
+
+// NewStats creates a new, empty stats collector.
+func NewStats() *Stats {
+	return &Stats{
+		failures: make(map[string]int64),
+		servers:  make(map[string]*serverStats),
+	}
+}
+
+// recordRequest records the outcome and latency of a single HTTP request.
+func (s *Stats) recordRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	if s == nil {
+		return
+	}
+	server := req.URL.Scheme + "://" + req.URL.Host
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.servers[server]
+	if !ok {
+		ss = &serverStats{}
+		s.servers[server] = ss
+	}
+	ss.requests++
+	ss.latencies = append(ss.latencies, elapsed)
+	if err != nil || resp.StatusCode >= 500 {
+		ss.errors++
+	}
+	if strings.HasSuffix(req.URL.Path, "/_bulk") {
+		ss.bulk.observe(elapsed.Seconds())
+	}
+}
+
+// requestStarted marks a request as in flight and returns a function to call,
+// once the request has finished.
+func (s *Stats) requestStarted() func() {
+	if s == nil {
+		return func() {}
+	}
+	s.InFlight.Add(1)
+	return func() { s.InFlight.Add(-1) }
+}
+
+// recordBatch records a bulk request body about to be sent.
+func (s *Stats) recordBatch(size, sent int) {
+	if s == nil {
+		return
+	}
+	s.Batches.Add(1)
+	s.Bytes.Add(int64(size))
+	s.BytesSent.Add(int64(sent))
+}
+
+// recordSkipped records a broken document, that has been skipped.
+func (s *Stats) recordSkipped() {
+	if s == nil {
+		return
+	}
+	s.SkippedBroken.Add(1)
+}
+
+// recordUnchanged records documents skipped, because they did not change.
+func (s *Stats) recordUnchanged(n int) {
+	if s == nil {
+		return
+	}
+	s.Unchanged.Add(int64(n))
+}
+
+// recordFailedBatch records a bulk request, that failed as a whole.
+func (s *Stats) recordFailedBatch(numDocs int, errType string) {
+	if s == nil {
+		return
+	}
+	s.DocsSent.Add(int64(numDocs))
+	s.recordFailures(errType, int64(numDocs))
+}
+
+// recordFailures adds n failed documents with a given error type.
+func (s *Stats) recordFailures(errType string, n int64) {
+	s.Failed.Add(n)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[errType] += n
+}
+
+// recordItems records the outcome of each item of a bulk response.
+func (s *Stats) recordItems(br *BulkResponse) {
+	if s == nil {
+		return
+	}
+	s.DocsSent.Add(int64(len(br.Items)))
+	for _, item := range br.Items {
+		result := item.Action()
+		if !item.Succeeded() {
+			errType := result.Error.Type
+			if errType == "" {
+				errType = "unknown"
+			}
+			s.recordFailures(errType, 1)
+			continue
+		}
+		switch result.Result {
+		case "created":
+			s.Created.Add(1)
+		case "updated":
+			s.Updated.Add(1)
+		case "deleted", "not_found":
+			s.Deleted.Add(1)
+		case "noop":
+			s.Noop.Add(1)
+		}
+	}
+}
+
+// Report is a summary of a run, suitable for machine consumption.
+type Report struct {
+	Index      string                  `json:"index"`
+	Started    time.Time               `json:"started"`
+	Finished   time.Time               `json:"finished"`
+	ExitReason string                  `json:"exit_reason"` // success, error or cancelled
+	Error      string                  `json:"error,omitempty"`
+	Docs       ReportDocs              `json:"docs"`
+	Failures   map[string]int64        `json:"failures_by_type"`
+	Retries    int64                   `json:"retries"`
+	Batches    int64                   `json:"batches"`
+	Bytes      int64                   `json:"bytes"`      // uncompressed
+	BytesSent  int64                   `json:"bytes_sent"` // compressed, if enabled
+	Servers    map[string]ServerReport `json:"servers"`
+	Phases     ReportPhases            `json:"phases"`
+}
+
+// ReportDocs are the document counts of a run.
+type ReportDocs struct {
+	Read          int64 `json:"read"`
+	Sent          int64 `json:"sent"`
+	Created       int64 `json:"created"`
+	Updated       int64 `json:"updated"`
+	Deleted       int64 `json:"deleted"`
+	Noop          int64 `json:"noop"`
+	Failed        int64 `json:"failed"`
+	SkippedBroken int64 `json:"skipped_broken"`
+	Unchanged     int64 `json:"unchanged"`
+	Duplicates    int64 `json:"duplicates"`
+}
+
+// ServerReport summarizes the requests sent to a single server. Latencies are
+// in milliseconds.
+type ServerReport struct {
+	Requests   int64   `json:"requests"`
+	Errors     int64   `json:"errors"`
+	LatencyP50 float64 `json:"latency_p50_ms"`
+	LatencyP90 float64 `json:"latency_p90_ms"`
+	LatencyP99 float64 `json:"latency_p99_ms"`
+	LatencyMax float64 `json:"latency_max_ms"`
+}
+
+// ReportPhases are the durations of the phases of a run, in seconds.
+type ReportPhases struct {
+	Setup    float64 `json:"setup"`
+	Load     float64 `json:"load"`
+	Teardown float64 `json:"teardown"`
+}
+
+// Report returns a summary of the stats collected so far.
+func (s *Stats) Report() *Report {
+	report := &Report{
+		Docs: ReportDocs{
+			Read:          s.DocsRead.Load(),
+			Sent:          s.DocsSent.Load(),
+			Created:       s.Created.Load(),
+			Updated:       s.Updated.Load(),
+			Deleted:       s.Deleted.Load(),
+			Noop:          s.Noop.Load(),
+			Failed:        s.Failed.Load(),
+			SkippedBroken: s.SkippedBroken.Load(),
+			Unchanged:     s.Unchanged.Load(),
+			Duplicates:    s.Duplicates.Load(),
+		},
+		Failures:  make(map[string]int64),
+		Retries:   s.Retries.Load(),
+		Batches:   s.Batches.Load(),
+		Bytes:     s.Bytes.Load(),
+		BytesSent: s.BytesSent.Load(),
+		Servers:   make(map[string]ServerReport),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.failures {
+		report.Failures[k] = v
+	}
+	for server, ss := range s.servers {
+		latencies := make([]time.Duration, len(ss.latencies))
+		copy(latencies, ss.latencies)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		report.Servers[server] = ServerReport{
+			Requests:   ss.requests,
+			Errors:     ss.errors,
+			LatencyP50: percentile(latencies, 0.50),
+			LatencyP90: percentile(latencies, 0.90),
+			LatencyP99: percentile(latencies, 0.99),
+			LatencyMax: percentile(latencies, 1),
+		}
+	}
+	return report
+}
+
+// percentile returns the p-th percentile of sorted durations in milliseconds,
+// using the nearest rank method.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
+
+// exitReason classifies the final error of a run.
+func exitReason(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	default:
+		return "error"
+	}
+}
+
+// WriteFile writes the report as JSON to a file.
+func (r *Report) WriteFile(filename string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(b, '\n'), 0644)
+}
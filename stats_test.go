@@ -0,0 +1,178 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/segmentio/encoding/json"
+)
+
+func TestPercentile(t *testing.T) {
+	var ms []time.Duration
+	for i := 1; i <= 10; i++ {
+		ms = append(ms, time.Duration(i)*time.Millisecond)
+	}
+	var cases = []struct {
+		sorted []time.Duration
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{ms[:1], 0.5, 1},
+		{ms[:1], 0.99, 1},
+		{ms, 0.5, 5},
+		{ms, 0.9, 9},
+		{ms, 0.99, 10},
+		{ms, 1, 10},
+		{ms, 0, 1},
+		{[]time.Duration{1500 * time.Microsecond}, 1, 1.5},
+	}
+	for _, c := range cases {
+		if got := percentile(c.sorted, c.p); got != c.want {
+			t.Errorf("percentile(%v, %v): got %v, want %v", c.sorted, c.p, got, c.want)
+		}
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	var cases = []struct {
+		err  error
+		want string
+	}{
+		{nil, "success"},
+		{context.Canceled, "cancelled"},
+		{fmt.Errorf("worker errors occurred: %w", context.Canceled), "cancelled"},
+		{errors.New("bulk request failed"), "error"},
+		{context.DeadlineExceeded, "error"},
+	}
+	for _, c := range cases {
+		if got := exitReason(c.err); got != c.want {
+			t.Errorf("exitReason(%v): got %s, want %s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	var (
+		stats = NewStats()
+		req   = func(path string) *http.Request {
+			r, _ := http.NewRequest("POST", "http://es:9200"+path, nil)
+			return r
+		}
+	)
+	for i := 1; i <= 10; i++ {
+		status := http.StatusOK
+		if i == 10 {
+			status = http.StatusServiceUnavailable
+		}
+		stats.recordRequest(req("/abc/_bulk"), &http.Response{StatusCode: status}, nil, time.Duration(i)*time.Millisecond)
+	}
+	stats.recordRequest(req("/abc/_flush"), nil, errors.New("connection refused"), time.Millisecond)
+	stats.DocsRead.Add(5)
+	stats.recordBatch(100, 40)
+	stats.recordItems(&BulkResponse{Items: []Item{
+		{IndexAction: ItemResult{Status: 201, Result: "created"}},
+		{IndexAction: ItemResult{Status: 200, Result: "updated"}},
+		{IndexAction: ItemResult{Status: 200, Result: "noop"}},
+		{IndexAction: ItemResult{Status: 400, Error: ItemError{Type: "mapper_parsing_exception"}}},
+	}})
+	stats.recordFailedBatch(1, "es_rejected_execution_exception")
+
+	r := &Runner{
+		IndexName:  "abc",
+		ReportFile: filepath.Join(t.TempDir(), "report.json"),
+		stats:      stats,
+	}
+	started := time.Now().Add(-3 * time.Second)
+	loadStarted := started.Add(time.Second)
+	if err := r.writeReport(started, loadStarted, time.Time{}, errors.New("worker errors occurred")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(r.ReportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report map[string]any
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range report {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	wantKeys := []string{"batches", "bytes", "bytes_sent", "docs", "error", "exit_reason",
+		"failures_by_type", "finished", "index", "phases", "retries", "servers", "started"}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Fatalf("got keys %v, want %v", keys, wantKeys)
+	}
+	var cases = []struct {
+		path []string
+		want any
+	}{
+		{[]string{"index"}, "abc"},
+		{[]string{"exit_reason"}, "error"},
+		{[]string{"error"}, "worker errors occurred"},
+		{[]string{"bytes"}, 100.0},
+		{[]string{"bytes_sent"}, 40.0},
+		{[]string{"docs", "read"}, 5.0},
+		{[]string{"docs", "sent"}, 5.0},
+		{[]string{"docs", "created"}, 1.0},
+		{[]string{"docs", "updated"}, 1.0},
+		{[]string{"docs", "noop"}, 1.0},
+		{[]string{"docs", "failed"}, 2.0},
+		{[]string{"failures_by_type", "mapper_parsing_exception"}, 1.0},
+		{[]string{"failures_by_type", "es_rejected_execution_exception"}, 1.0},
+		{[]string{"servers", "http://es:9200", "requests"}, 11.0},
+		{[]string{"servers", "http://es:9200", "errors"}, 2.0},
+		{[]string{"servers", "http://es:9200", "latency_p50_ms"}, 5.0},
+		{[]string{"servers", "http://es:9200", "latency_p90_ms"}, 9.0},
+		{[]string{"servers", "http://es:9200", "latency_max_ms"}, 10.0},
+		{[]string{"phases", "teardown"}, 0.0},
+	}
+	for _, c := range cases {
+		var v any = report
+		for _, k := range c.path {
+			v = v.(map[string]any)[k]
+		}
+		if v != c.want {
+			t.Errorf("%v: got %v, want %v", c.path, v, c.want)
+		}
+	}
+	phases := report["phases"].(map[string]any)
+	if setup := phases["setup"].(float64); setup < 0.9 || setup > 1.1 {
+		t.Errorf("got setup %v, want 1s", setup)
+	}
+	if load := phases["load"].(float64); load < 1.9 {
+		t.Errorf("got load %v, want at least 2s", load)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/segmentio/encoding/json"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	syncDocsBucket    = []byte("docs")
+	syncMetaBucket    = []byte("meta")
+	syncGenerationKey = []byte("generation")
+	syncScopeKey      = []byte("scope")
+)
+
+// SyncStore keeps a content hash of every document indexed so far, keyed by
+// document ID. It allows a run to only send new or changed documents and to
+// delete documents, that are no longer part of the input.
+//
+// Each run gets a new generation number. Every document seen during a run is
+// tagged with the current generation, so documents with an older generation
+// are stale once the whole input has been indexed.
+//
+// The hashes are only valid for one scope, like the index and the settings
+// that change documents after they are hashed. A store opened with another
+// scope starts over.
+type SyncStore struct {
+	db         *bolt.DB
+	generation uint64
+	unchanged  atomic.Int64
+	rescoped   bool // documents were dropped, because the scope changed
+}
+
+// syncEntry is a document ID along with the hash of the document content.
+type syncEntry struct {
+	id   string
+	hash uint64
+}
+
+// OpenSyncStore opens or creates a sync store at the given path for a scope
+// and starts a new generation.
+func OpenSyncStore(filename, scope string) (*SyncStore, error) {
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &SyncStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		docs, err := tx.CreateBucketIfNotExists(syncDocsBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(syncMetaBucket)
+		if err != nil {
+			return err
+		}
+		if string(meta.Get(syncScopeKey)) != scope {
+			if k, _ := docs.Cursor().First(); k != nil {
+				if err := tx.DeleteBucket(syncDocsBucket); err != nil {
+					return err
+				}
+				if _, err := tx.CreateBucket(syncDocsBucket); err != nil {
+					return err
+				}
+				s.rescoped = true
+			}
+			if err := meta.Put(syncScopeKey, []byte(scope)); err != nil {
+				return err
+			}
+		}
+		if v := meta.Get(syncGenerationKey); len(v) == 8 {
+			s.generation = binary.BigEndian.Uint64(v)
+		}
+		s.generation++
+		return meta.Put(syncGenerationKey, binary.BigEndian.AppendUint64(nil, s.generation))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reset forgets all documents, e.g. after the index has been deleted, so
+// that every document is sent again.
+func (s *SyncStore) Reset() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(syncDocsBucket); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		_, err := tx.CreateBucket(syncDocsBucket)
+		return err
+	})
+}
+
+// Close closes the underlying database.
+func (s *SyncStore) Close() error {
+	return s.db.Close()
+}
+
+// Unchanged returns the number of documents skipped so far, because they did
+// not change since the last run.
+func (s *SyncStore) Unchanged() int64 {
+	return s.unchanged.Load()
+}
+
+// Index sends all new or changed documents to elasticsearch. Unchanged
+// documents are only marked as seen. The store is updated only for the
+// documents that were indexed successfully.
+func (s *SyncStore) Index(ctx context.Context, docs []string, options Options) error {
+	var (
+		send    []string
+		pending []syncEntry
+		seen    []syncEntry
+	)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(syncDocsBucket)
+		for _, doc := range docs {
+			if len(strings.TrimSpace(doc)) == 0 {
+				continue
+			}
+			id, _, err := documentID(doc, options)
+			if err != nil {
+				return err
+			}
+			entry := syncEntry{id: id, hash: xxhash.Sum64String(doc)}
+			if v := b.Get([]byte(id)); len(v) == 16 && binary.BigEndian.Uint64(v[8:]) == entry.hash {
+				seen = append(seen, entry)
+				continue
+			}
+			send = append(send, doc)
+			pending = append(pending, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.put(seen); err != nil {
+		return err
+	}
+	s.unchanged.Add(int64(len(seen)))
+	options.Stats.recordUnchanged(len(seen))
+	if len(send) == 0 {
+		return nil
+	}
+	br, err := BulkIndexResponse(ctx, send, options)
+	if br == nil {
+		return err
+	}
+	var done []syncEntry
+	for i, item := range br.Items {
+		if i < len(pending) && item.Succeeded() {
+			done = append(done, pending[i])
+		}
+	}
+	if perr := s.put(done); perr != nil {
+		return errors.Join(err, perr)
+	}
+	return err
+}
+
+// DeleteStale deletes all documents from the index, that have been indexed in
+// a previous run, but were not seen in the current one. It must only be called
+// after the complete input has been indexed successfully. Returns the number of
+// deleted documents.
+func (s *SyncStore) DeleteStale(ctx context.Context, options Options) (int, error) {
+	var (
+		after   []byte
+		deleted int
+	)
+	for {
+		ids, err := s.stale(after, options.BatchSize)
+		if err != nil {
+			return deleted, err
+		}
+		if len(ids) == 0 {
+			return deleted, nil
+		}
+		after = []byte(ids[len(ids)-1])
+		br, err := BulkDelete(ctx, ids, options)
+		if br == nil {
+			return deleted, err
+		}
+		var done []string
+		for i, item := range br.Items {
+			if i < len(ids) && item.Succeeded() {
+				done = append(done, ids[i])
+			}
+		}
+		if rerr := s.remove(done); rerr != nil {
+			return deleted, errors.Join(err, rerr)
+		}
+		deleted += len(done)
+		if err != nil {
+			return deleted, err
+		}
+	}
+}
+
+// put records entries as indexed in the current generation.
+func (s *SyncStore) put(entries []syncEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(syncDocsBucket)
+		for _, e := range entries {
+			v := binary.BigEndian.AppendUint64(nil, s.generation)
+			v = binary.BigEndian.AppendUint64(v, e.hash)
+			if err := b.Put([]byte(e.id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// remove drops the given IDs from the store.
+func (s *SyncStore) remove(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(syncDocsBucket)
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stale returns up to n IDs, sorted and greater than after, that have not
+// been seen in the current generation.
+func (s *SyncStore) stale(after []byte, n int) ([]string, error) {
+	if n <= 0 {
+		n = 1000
+	}
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(syncDocsBucket).Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if k != nil && string(k) == string(after) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && len(ids) < n; k, v = c.Next() {
+			if len(v) == 16 && binary.BigEndian.Uint64(v[:8]) == s.generation {
+				continue
+			}
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// syncScope describes what the hashes of a sync store are valid for: the
+// index and the settings that change documents after they have been hashed.
+func (r *Runner) syncScope() string {
+	b, _ := json.Marshal(map[string]string{
+		"index":    r.IndexName,
+		"include":  r.Include,
+		"exclude":  r.Exclude,
+		"pipeline": r.Pipeline,
+	})
+	return string(b)
+}
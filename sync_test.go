@@ -0,0 +1,134 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncStore(t *testing.T) {
+	var (
+		fake    = &fakeBulkServer{}
+		ts      = httptest.NewServer(fake)
+		ctx     = context.Background()
+		dbfile  = filepath.Join(t.TempDir(), "sync.db")
+		options = Options{
+			Servers:   []string{ts.URL},
+			Index:     "test",
+			OpType:    "index",
+			BatchSize: 10,
+			IDField:   "id",
+		}
+	)
+	defer ts.Close()
+	var runs = []struct {
+		scope string
+		docs  []string
+		want  []string
+	}{
+		{
+			scope: "a",
+			docs:  []string{`{"id": "1", "v": "a"}`, `{"id": "2", "v": "b"}`, `{"id": "3", "v": "c"}`},
+			want:  []string{"index 1", "index 2", "index 3"},
+		},
+		{
+			scope: "a",
+			docs:  []string{`{"id": "1", "v": "a"}`, `{"id": "2", "v": "B"}`},
+			want:  []string{"index 2", "delete 3"},
+		},
+		{
+			scope: "a",
+			docs:  []string{`{"id": "1", "v": "a"}`, `{"id": "2", "v": "B"}`},
+			want:  nil,
+		},
+		{
+			// Another index or filter, nothing has been sent there yet.
+			scope: "b",
+			docs:  []string{`{"id": "1", "v": "a"}`, `{"id": "2", "v": "B"}`},
+			want:  []string{"index 1", "index 2"},
+		},
+	}
+	for i, run := range runs {
+		store, err := OpenSyncStore(dbfile, run.scope)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		options.SyncStore = store
+		if err := store.Index(ctx, run.docs, options); err != nil {
+			t.Fatalf("[%d] index: %v", i, err)
+		}
+		if _, err := store.DeleteStale(ctx, options); err != nil {
+			t.Fatalf("[%d] delete: %v", i, err)
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		got := fake.reset()
+		if strings.Join(got, ", ") != strings.Join(run.want, ", ") {
+			t.Errorf("[%d] got %v, want %v", i, got, run.want)
+		}
+	}
+}
+
+func TestSyncStoreReset(t *testing.T) {
+	var (
+		fake    = &fakeBulkServer{}
+		ts      = httptest.NewServer(fake)
+		ctx     = context.Background()
+		docs    = []string{`{"id": "1"}`, `{"id": "2"}`}
+		options = Options{
+			Servers:   []string{ts.URL},
+			Index:     "test",
+			OpType:    "index",
+			BatchSize: 10,
+			IDField:   "id",
+		}
+	)
+	defer ts.Close()
+	store, err := OpenSyncStore(filepath.Join(t.TempDir(), "sync.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	options.SyncStore = store
+	for i, want := range []int{2, 0} {
+		if err := store.Index(ctx, docs, options); err != nil {
+			t.Fatal(err)
+		}
+		if got := fake.reset(); len(got) != want {
+			t.Fatalf("[%d] got %v, want %d items", i, got, want)
+		}
+	}
+	if err := store.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Index(ctx, docs, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.reset(); len(got) != 2 {
+		t.Fatalf("got %v after reset, want 2 items", got)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// ErrInvalidDocument is returned, if a document is not a JSON object.
+var ErrInvalidDocument = errors.New("document is not a valid JSON object")
+
+// Transform rewrites documents before they are indexed. A transform can drop
+// a document by returning none, or fan it out by returning several.
+// Transforms are applied by the workers and must be safe for concurrent use.
+type Transform interface {
+	Transform(doc string) ([]string, error)
+}
+
+// TransformChain applies transforms one after another.
+type TransformChain []Transform
+
+// Transform passes every document returned by a transform to the next.
+func (c TransformChain) Transform(doc string) ([]string, error) {
+	docs := []string{doc}
+	for _, t := range c {
+		var next []string
+		for _, d := range docs {
+			result, err := t.Transform(d)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, result...)
+		}
+		docs = next
+	}
+	return docs, nil
+}
+
+// FieldFilter keeps or removes fields of a document, given as dotted paths,
+// like "a,b.c". It scans the document and copies the parts to keep, without
+// decoding it, so the order of fields and the formatting of values are
+// preserved.
+type FieldFilter struct {
+	include  bool
+	paths    map[string]bool
+	prefixes map[string]bool // objects containing paths
+}
+
+// NewFieldFilter creates a filter for comma or space separated fields, that
+// keeps only the given fields, if include is true, and removes them
+// otherwise.
+func NewFieldFilter(fields string, include bool) *FieldFilter {
+	f := &FieldFilter{
+		include:  include,
+		paths:    make(map[string]bool),
+		prefixes: make(map[string]bool),
+	}
+	for _, path := range strings.FieldsFunc(fields, func(r rune) bool { return r == ',' || r == ' ' }) {
+		f.paths[path] = true
+		for i := range len(path) {
+			if path[i] == '.' {
+				f.prefixes[path[:i]] = true
+			}
+		}
+	}
+	return f
+}
+
+// Transform returns the filtered document.
+func (f *FieldFilter) Transform(doc string) ([]string, error) {
+	var (
+		b   = []byte(doc)
+		buf bytes.Buffer
+	)
+	buf.Grow(len(b))
+	i := skipSpace(b, 0)
+	end, _, err := f.filterObject(b, i, "", &buf)
+	if err != nil {
+		return nil, err
+	}
+	if skipSpace(b, end) != len(b) {
+		return nil, ErrInvalidDocument
+	}
+	return []string{buf.String()}, nil
+}
+
+// filterObject copies the object starting at b[i] to buf, keeping only the
+// members selected by the filter. It returns the position after the object
+// and the number of members written.
+func (f *FieldFilter) filterObject(b []byte, i int, prefix string, buf *bytes.Buffer) (int, int, error) {
+	if i >= len(b) || b[i] != '{' {
+		return 0, 0, ErrInvalidDocument
+	}
+	buf.WriteByte('{')
+	var written int
+	i = skipSpace(b, i+1)
+	if i < len(b) && b[i] == '}' {
+		buf.WriteByte('}')
+		return i + 1, 0, nil
+	}
+	for {
+		// Key.
+		keyEnd, err := scanString(b, i)
+		if err != nil {
+			return 0, 0, err
+		}
+		rawKey := b[i:keyEnd]
+		key, err := decodeKey(rawKey)
+		if err != nil {
+			return 0, 0, err
+		}
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		i = skipSpace(b, keyEnd)
+		if i >= len(b) || b[i] != ':' {
+			return 0, 0, ErrInvalidDocument
+		}
+		i = skipSpace(b, i+1)
+		// Value.
+		member := func() {
+			if written > 0 {
+				buf.WriteByte(',')
+			}
+			buf.Write(rawKey)
+			buf.WriteByte(':')
+			written++
+		}
+		switch {
+		case f.prefixes[path] && !f.paths[path] && i < len(b) && b[i] == '{':
+			// An object containing selected fields. Members are written to
+			// a separate buffer, to drop the object, if nothing remains.
+			var nested bytes.Buffer
+			end, n, err := f.filterObject(b, i, path, &nested)
+			if err != nil {
+				return 0, 0, err
+			}
+			if n > 0 || !f.include {
+				member()
+				buf.Write(nested.Bytes())
+			}
+			i = end
+		default:
+			end, err := scanValue(b, i)
+			if err != nil {
+				return 0, 0, err
+			}
+			if f.paths[path] == f.include {
+				member()
+				buf.Write(b[i:end])
+			}
+			i = end
+		}
+		i = skipSpace(b, i)
+		if i >= len(b) {
+			return 0, 0, ErrInvalidDocument
+		}
+		switch b[i] {
+		case ',':
+			i = skipSpace(b, i+1)
+		case '}':
+			buf.WriteByte('}')
+			return i + 1, written, nil
+		default:
+			return 0, 0, ErrInvalidDocument
+		}
+	}
+}
+
+// scanField returns the raw value at a path of keys in the object starting at
+// b[i], or nil, if there is none. Like a decoder, it uses the last one of
+// duplicate keys.
+func scanField(b []byte, i int, path []string) ([]byte, error) {
+	if i >= len(b) || b[i] != '{' {
+		return nil, ErrInvalidDocument
+	}
+	var found []byte
+	i = skipSpace(b, i+1)
+	if i < len(b) && b[i] == '}' {
+		return nil, nil
+	}
+	for {
+		keyEnd, err := scanString(b, i)
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeKey(b[i:keyEnd])
+		if err != nil {
+			return nil, err
+		}
+		i = skipSpace(b, keyEnd)
+		if i >= len(b) || b[i] != ':' {
+			return nil, ErrInvalidDocument
+		}
+		i = skipSpace(b, i+1)
+		end, err := scanValue(b, i)
+		if err != nil {
+			return nil, err
+		}
+		if key == path[0] {
+			switch {
+			case len(path) == 1:
+				found = b[i:end]
+			case b[i] == '{':
+				if found, err = scanField(b, i, path[1:]); err != nil {
+					return nil, err
+				}
+			default:
+				found = nil
+			}
+		}
+		i = skipSpace(b, end)
+		if i >= len(b) {
+			return nil, ErrInvalidDocument
+		}
+		switch b[i] {
+		case ',':
+			i = skipSpace(b, i+1)
+		case '}':
+			return found, nil
+		default:
+			return nil, ErrInvalidDocument
+		}
+	}
+}
+
+// decodeKey returns the value of a raw JSON string, decoding it only if it
+// contains escapes.
+func decodeKey(raw []byte) (string, error) {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return string(raw[1 : len(raw)-1]), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", ErrInvalidDocument
+	}
+	return s, nil
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// scanString returns the position after the string starting at b[i].
+func scanString(b []byte, i int) (int, error) {
+	if i >= len(b) || b[i] != '"' {
+		return 0, ErrInvalidDocument
+	}
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+	return 0, ErrInvalidDocument
+}
+
+// scanValue returns the position after the value starting at b[i]. Literals
+// and numbers are only delimited, not validated.
+func scanValue(b []byte, i int) (int, error) {
+	if i >= len(b) {
+		return 0, ErrInvalidDocument
+	}
+	switch b[i] {
+	case '"':
+		return scanString(b, i)
+	case '{', '[':
+		depth := 0
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case '"':
+				end, err := scanString(b, i)
+				if err != nil {
+					return 0, err
+				}
+				i = end - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, nil
+				}
+			}
+		}
+		return 0, ErrInvalidDocument
+	default:
+		start := i
+	loop:
+		for ; i < len(b); i++ {
+			switch b[i] {
+			case ',', ' ', '\t', '\r', '\n', '}', ']':
+				break loop
+			}
+		}
+		if i == start {
+			return 0, ErrInvalidDocument
+		}
+		return i, nil
+	}
+}
+
+// transform builds the transform for a run from its options, followed by a
+// custom transform, if any. It returns nil, if there is nothing to do.
+func (r *Runner) transform() (Transform, error) {
+	var chain TransformChain
+	if r.TransformScript != "" {
+		t, err := NewScriptTransform(r.ctx, r.TransformScript, r.NumWorkers, r.TransformTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("transform script: %w", err)
+		}
+		chain = append(chain, t)
+	}
+	if r.Transform != nil {
+		chain = append(chain, r.Transform)
+	}
+	switch len(chain) {
+	case 0:
+		return nil, nil
+	case 1:
+		return chain[0], nil
+	default:
+		return chain, nil
+	}
+}
+
+// sourceFilter builds the filter for the fields to include or exclude. The
+// fields are removed only after the ID has been read, so that the ID field
+// itself can be excluded. It returns nil, if there is nothing to do.
+func (r *Runner) sourceFilter() Transform {
+	var chain TransformChain
+	if r.Include != "" {
+		chain = append(chain, NewFieldFilter(r.Include, true))
+	}
+	if r.Exclude != "" {
+		chain = append(chain, NewFieldFilter(r.Exclude, false))
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	default:
+		return chain
+	}
+}
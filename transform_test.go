@@ -0,0 +1,164 @@
+// Copyright 2021 by Leipzig University Library, http://ub.uni-leipzig.de
+//                   The Finc Authors, http://finc.info
+//                   Martin Czygan, <martin.czygan@uni-leipzig.de>
+//
+// This file is part of some open source application.
+//
+// Some open source application is free software: you can redistribute
+// it and/or modify it under the terms of the GNU General Public
+// License as published by the Free Software Foundation, either
+// version 3 of the License, or (at your option) any later version.
+//
+// Some open source application is distributed in the hope that it will
+// be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+// of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Foobar.  If not, see <http://www.gnu.org/licenses/>.
+//
+// @license GPL-3.0+ <http://spdx.org/licenses/GPL-3.0+>
+
+package esbulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFieldFilter(t *testing.T) {
+	doc := `{"id": 1, "title": "a \"quoted\" {title}", "person": {"name": "x", "email": "y", "tags": [1, {"a": 2}]}, "raw": {"text": "z"}, "n": null}`
+	var cases = []struct {
+		fields  string
+		include bool
+		want    string
+	}{
+		{"", false, `{"id":1,"title":"a \"quoted\" {title}","person":{"name": "x", "email": "y", "tags": [1, {"a": 2}]},"raw":{"text": "z"},"n":null}`},
+		{"raw,person.email", false, `{"id":1,"title":"a \"quoted\" {title}","person":{"name":"x","tags":[1, {"a": 2}]},"n":null}`},
+		{"person,person.name", false, `{"id":1,"title":"a \"quoted\" {title}","raw":{"text": "z"},"n":null}`},
+		{"raw.text", false, `{"id":1,"title":"a \"quoted\" {title}","person":{"name": "x", "email": "y", "tags": [1, {"a": 2}]},"raw":{},"n":null}`},
+		{"id,person.name", true, `{"id":1,"person":{"name":"x"}}`},
+		{"id,title.x,raw.missing", true, `{"id":1}`},
+		{"n person", true, `{"person":{"name": "x", "email": "y", "tags": [1, {"a": 2}]},"n":null}`},
+	}
+	for _, c := range cases {
+		got, err := NewFieldFilter(c.fields, c.include).Transform(doc)
+		if err != nil {
+			t.Fatalf("%s: %v", c.fields, err)
+		}
+		if len(got) != 1 || got[0] != c.want {
+			t.Fatalf("%s (include: %v): got %v, want %s", c.fields, c.include, got, c.want)
+		}
+	}
+	for _, broken := range []string{`{"a": 1`, `[1]`, `{"a" 1}`, `{"a": 1} x`, `{"a": "1}`, ``} {
+		if _, err := NewFieldFilter("a", false).Transform(broken); !errors.Is(err, ErrInvalidDocument) {
+			t.Fatalf("%s: got %v, want %v", broken, err, ErrInvalidDocument)
+		}
+	}
+}
+
+func TestWorkerTransform(t *testing.T) {
+	var (
+		fake    = &fakeBulkServer{}
+		ts      = httptest.NewServer(fake)
+		stats   = NewStats()
+		lines   = make(chan string, 3)
+		errChan = make(chan error, 3)
+		wg      sync.WaitGroup
+		options = Options{
+			Servers:    []string{ts.URL},
+			Index:      "test",
+			OpType:     "index",
+			BatchSize:  10,
+			IDField:    "id",
+			Transform:  NewFieldFilter("secret", false),
+			SkipBroken: true,
+			Stats:      stats,
+		}
+	)
+	defer ts.Close()
+	lines <- `{"id": "1", "secret": "x"}`
+	lines <- `{"id": "2"`
+	lines <- `{"id": "3", "secret": "y"}`
+	close(lines)
+	wg.Add(1)
+	Worker(context.Background(), "w", options, lines, &wg, errChan)
+	close(errChan)
+	for err := range errChan {
+		t.Fatal(err)
+	}
+	if got := strings.Join(fake.sources, ","); got != `{"id":"1"},{"id":"3"}` {
+		t.Fatalf("got %s", got)
+	}
+	if got := strings.Join(fake.reset(), ","); got != "index 1,index 3" {
+		t.Fatalf("got %s", got)
+	}
+	if n := stats.SkippedBroken.Load(); n != 1 {
+		t.Fatalf("got %d skipped, want 1", n)
+	}
+}
+
+func TestRunSourceFilter(t *testing.T) {
+	cluster := &fakeCluster{index: "abc"}
+	ts := httptest.NewServer(cluster)
+	defer ts.Close()
+	f, err := os.CreateTemp(t.TempDir(), "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(f, `{"id": "1", "title": "a", "person": {"id": "p1", "name": "x"}}`)
+	fmt.Fprintln(f, `{"id": "2", "title": "b", "person": {"id": "p2", "name": "y"}}`)
+	fmt.Fprintln(f, `{"id": "1", "title": "c", "person": {"id": "p3", "name": "z"}}`)
+	// The ID is read before fields are removed, in all stages.
+	var cases = []struct {
+		r       Runner
+		actions []string
+		sources []string
+	}{
+		{
+			Runner{IdentifierField: "id", Exclude: "id,person"},
+			[]string{"index 1", "index 2", "index 1"},
+			[]string{`{"title":"a"}`, `{"title":"b"}`, `{"title":"c"}`},
+		},
+		{
+			Runner{IdentifierField: "person.id", Include: "title"},
+			[]string{"index p1", "index p2", "index p3"},
+			[]string{`{"title":"a"}`, `{"title":"b"}`, `{"title":"c"}`},
+		},
+		{
+			Runner{IdentifierField: "id", Include: "title", Dedup: DedupLast, Ordered: true},
+			[]string{"index 2", "index 1"},
+			[]string{`{"title":"b"}`, `{"title":"c"}`},
+		},
+	}
+	for i, c := range cases {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		r := c.r
+		r.Servers = []string{ts.URL}
+		r.BatchSize = 10
+		r.NumWorkers = 1
+		r.RefreshInterval = "1s"
+		r.IndexName = "abc"
+		r.OpType = "index"
+		r.File = f
+		r.StateFile = filepath.Join(t.TempDir(), "state.json")
+		if err := r.Run(); err != nil {
+			t.Fatalf("[%d] %v", i, err)
+		}
+		sources := cluster.sources
+		if got := cluster.reset(); !reflect.DeepEqual(got, c.actions) || !reflect.DeepEqual(sources, c.sources) {
+			t.Errorf("[%d] got %v %v, want %v %v", i, got, sources, c.actions, c.sources)
+		}
+	}
+}